@@ -0,0 +1,28 @@
+package con
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Identity - authenticated identity of client.
+type Identity struct {
+	// Name replaces client name from handshake if not empty.
+	Name  string
+	Attrs map[string]string
+}
+
+// PeerInfo - transport level info about connecting client.
+type PeerInfo struct {
+	Addr net.Addr
+	TLS  *tls.ConnectionState
+	Cred *PeerCred
+	// Identity from verified client certificate (CN or the
+	// first SAN).
+	CertName string
+}
+
+// Authenticator checks client credentials sent in handshake.
+// Returned Identity.Name replaces client name, empty one keeps
+// name from verified certificate in identity.
+type Authenticator func(name string, credentials []byte, peer PeerInfo) (Identity, error)
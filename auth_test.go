@@ -0,0 +1,86 @@
+package con
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{
+		Authenticate: func(name string, credentials []byte, peer PeerInfo) (Identity, error) {
+			if string(credentials) != "secret" {
+				return Identity{}, errors.New("bad credentials")
+			}
+			return Identity{Name: "admin"}, nil
+		},
+	}
+	pings := make(chan Msg, 10)
+	server.On("admin", "ping", func(msg Msg) (ans []byte) {
+		pings <- msg
+		return []byte("pong")
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Rejected
+	client := Client{Credentials: []byte("wrong")}
+	err := client.Connect(addr, "admin")
+	var re *RemoteError
+	if !errors.As(err, &re) || re.Code != CodeAuthFailed {
+		t.Fatalf("Client should be rejected, got: %v", err)
+	}
+
+	// Messages without handshake are dropped
+	stream, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMsg(stream, BID12(), 0, "ping", nil)
+	stream.Close()
+
+	// Accepted, name is taken from identity
+	client = Client{Credentials: []byte("secret")}
+	err = client.Connect(addr, "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	ans, err := client.Request(context.Background(), "ping", nil)
+	if err != nil || string(ans.Body) != "pong" {
+		t.Fatalf("Unexpected answer: %q, %v", ans.Body, err)
+	}
+	if len(pings) != 1 {
+		t.Errorf("Wrong count of handled messages: %d", len(pings))
+	}
+}
+
+func TestBroadcastUnauthenticated(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{
+		Authenticate: func(name string, credentials []byte, peer PeerInfo) (Identity, error) {
+			return Identity{}, errors.New("nobody is allowed")
+		},
+	}
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Connection without handshake
+	stream, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	server.Broadcast("secret", []byte("payload"))
+	server.BroadcastExcept("", "", "secret", []byte("payload"))
+	stream.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := stream.Read(make([]byte, 64)); n != 0 {
+		t.Errorf("Unauthenticated connection got %d bytes", n)
+	}
+}
@@ -1,49 +1,155 @@
 package con
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"regexp"
 	"sync"
+	"time"
 )
 
 // Client struct.
 type Client struct {
 	sync.RWMutex
-	ID     string
-	stream Conn
-	rules  []Rule
+	ID string
+
+	// Negotiated protocol version and features.
+	Version  int
+	Features []string
+
+	// MinVersion - the lowest protocol version client accepts.
+	MinVersion int
+
+	// Reconnect enables automatic reconnection when the
+	// connection to the server is lost. Nil - disabled.
+	Reconnect *ReconnectOptions
+
+	// Codec for typed messages. Nil - DefaultCodec.
+	Codec Codec
+
+	// TLSConfig enables TLS for tcp addresses. Set Certificates
+	// for mutual TLS.
+	TLSConfig *tls.Config
+
+	// Credentials sent in handshake, see Server.Authenticate.
+	Credentials []byte
+
+	// Dispatch - how handlers are executed, concurrently (default)
+	// or in order of messages.
+	Dispatch DispatchMode
+
+	// QueueSize - size of handlers queue in ordered dispatch modes.
+	// Reading is paused while the queue is full. 0 - DefaultQueueSize.
+	QueueSize int
+
+	// Workers - max number of running handlers, 0 - unlimited.
+	// Reading is paused while all workers are busy.
+	Workers int
+
+	// MaxInFlight - max number of queued and running handlers of
+	// connection, 0 - unlimited. Reading is paused when the limit
+	// is hit, so the server is slowed down by the connection flow
+	// control. Answers of requests are not read meanwhile too.
+	MaxInFlight int
+
+	// MaxNameLen - max length of message name, 0 - 255.
+	MaxNameLen int
+
+	// MaxBodySize - max size of message body, 0 - DefaultMaxBodySize,
+	// negative - no limit. Connection is closed with protocol error
+	// when server sends larger frame.
+	MaxBodySize int
+
+	// BorrowBodies - handlers get id and body of message without
+	// copying, they are valid only until handler returns. Reading
+	// waits for handlers of each message, so messages are handled
+	// one by one and handlers should not wait for answers.
+	BorrowBodies bool
+
+	// ErrorHandler is called on errors which can not be returned
+	// to caller, e.g. protocol errors of server and panics of
+	// handlers and interceptors (*PanicError).
+	ErrorHandler ErrorHandler
+
+	// Heartbeat enables pings of server if it supports them.
+	// Connection is lost when server does not answer. Nil - disabled.
+	Heartbeat *HeartbeatOptions
+
+	// IdleTimeout - connection is lost when server sends nothing
+	// during it, 0 - no limit.
+	IdleTimeout time.Duration
+
+	// Batch enables asynchronous writing: messages are queued and
+	// coalesced into vectored writes. Send returns when message is
+	// queued, use Flush to wait for writing. Nil - every message
+	// is written by its own write call.
+	Batch *BatchOptions
+
+	stream     Conn
+	rules      ruleTable
+	address    string
+	name       string
+	state      ClientState
+	closed     bool
+	queue      []queuedMsg
+	stateRules []func(state ClientState)
+	pending    map[string]chan Msg
+	workers    dispatcher
+	out        *writer
+	groups     map[string]bool
+
+	middleware   []Middleware
+	interceptors []Interceptor
+}
+
+// Message waiting for reconnection.
+type queuedMsg struct {
+	id      [12]byte
+	meta    byte
+	name    string
+	headers Headers
+	body    []byte
 }
 
 // Connect - try to connect to provided address.
 func (c *Client) Connect(address string, name string) (err error) {
-	c.stream, err = Dial(address)
-	if err != nil {
-		return err
-	}
+	c.Lock()
+	c.address = address
+	c.name = name
+	c.closed = false
+	c.Unlock()
 
-	// Handshake (sync)
-	err = c.handshake(name)
+	c.setState(StateConnecting)
+	err = c.connect()
 	if err != nil {
+		c.setState(StateClosed)
 		return err
 	}
 
-	// Start msg listener
-	go c.handleResponses()
 	return nil
 }
 
 // Send - without waiting of answer.
 func (c *Client) Send(name string, body []byte) error {
-	if c.ID == "" {
-		return ErrDisconnected
+	return c.SendMsg(Msg{Name: name, Body: body})
+}
+
+// SendMsg sends message with headers without waiting of answer.
+func (c *Client) SendMsg(msg Msg) error {
+	err := c.intercept(&msg)
+	if err != nil {
+		return err
 	}
 
 	id := BID12()
 	meta := byte(0)
-	if body != nil || len(body) > 0 {
+	if msg.Body != nil || len(msg.Body) > 0 {
 		meta = MsgWithBody
 	}
 
 	c.Lock()
-	err := writeMsg(c.stream, id, meta, name, body)
+	err = c.write(id, meta, msg.Name, msg.Headers, msg.Body)
 	c.Unlock()
 	if err != nil {
 		return err
@@ -54,108 +160,705 @@ func (c *Client) Send(name string, body []byte) error {
 
 // Req - with answer
 func (c *Client) Req(name string, body []byte, ch chan Msg) error {
-	if c.ID == "" {
-		return ErrDisconnected
+	msg := Msg{Name: name, Body: body}
+	err := c.intercept(&msg)
+	if err != nil {
+		return err
 	}
 
 	id := BID12()
 	meta := MsgReq
-	if body != nil {
+	if msg.Body != nil {
 		meta |= MsgWithBody
 	}
 
 	// Add handler for answer
 	c.Lock()
-	c.rules = append(c.rules, Rule{
-		handler: func(msg Msg) (ans []byte) {
+	if err := c.writable(); err != nil {
+		c.Unlock()
+		return err
+	}
+	rule := &Rule{
+		id:       nextRuleID(),
+		internal: true,
+		handler: func(msg Msg) (ans []byte, err error) {
 			ch <- msg
 			return
 		},
 		once:    true,
 		msgID:   id[:],
-		msgName: name,
-	})
+		msgName: msg.Name,
+	}
+	c.rules.add(rule)
 
-	err := writeMsg(c.stream, id, meta, name, body)
-	c.Unlock()
+	err = c.write(id, meta, msg.Name, msg.Headers, msg.Body)
 	if err != nil {
-		return err
+		c.rules.removeRule(rule)
 	}
+	c.Unlock()
+	return err
+}
 
-	return nil
+// Request sends message and waits for answer until it comes,
+// ctx is done or connection is lost. Error response of remote
+// handler is returned as *RemoteError.
+func (c *Client) Request(ctx context.Context, name string, body []byte) (Msg, error) {
+	return c.RequestMsg(ctx, Msg{Name: name, Body: body})
+}
+
+// RequestMsg sends message with headers and waits for answer
+// like Request.
+func (c *Client) RequestMsg(ctx context.Context, msg Msg) (Msg, error) {
+	err := c.intercept(&msg)
+	if err != nil {
+		return Msg{}, err
+	}
+	return c.request(ctx, msg)
 }
 
-// On subscribes on message by its name.
-func (c *Client) On(msgName string, h Handler) {
+// Send request without interceptors and wait for answer.
+func (c *Client) request(ctx context.Context, msg Msg) (Msg, error) {
+	id := BID12()
+	meta := MsgReq
+	if msg.Body != nil {
+		meta |= MsgWithBody
+	}
+
 	c.Lock()
-	c.rules = append(c.rules, Rule{
+	ch := c.addPending(id)
+	err := c.write(id, meta, msg.Name, msg.Headers, msg.Body)
+	if err != nil {
+		c.removePending(id)
+		c.Unlock()
+		return Msg{}, err
+	}
+	c.Unlock()
+
+	ans, err := c.wait(ctx, id, ch)
+	if err != nil {
+		return ans, err
+	}
+	return ans, ans.Err()
+}
+
+// On subscribes on message by its name. Name can be pattern
+// with "*" and ">" wildcards, empty - any.
+func (c *Client) On(msgName string, h Handler) *Subscription {
+	return c.addRule(Rule{
+		handler: h.withErr(),
+		msgName: msgName,
+	})
+}
+
+// OnErr subscribes on message by its name with handler that
+// can fail. Returned error is sent back if message is request.
+func (c *Client) OnErr(msgName string, h ErrHandler) *Subscription {
+	return c.addRule(Rule{
 		handler: h,
 		msgName: msgName,
 	})
+}
+
+// OnRegexp subscribes on messages which names match pattern.
+func (c *Client) OnRegexp(msgName *regexp.Regexp, h Handler) *Subscription {
+	return c.addRule(Rule{
+		handler:   h.withErr(),
+		msgRegexp: msgName,
+	})
+}
+
+// Off removes all handlers subscribed on message name. Handlers
+// of OnRegexp are removed only by Unsubscribe.
+func (c *Client) Off(msgName string) {
+	c.Lock()
+	c.rules.remove(func(r *Rule) bool {
+		return r.msgID == nil && r.msgRegexp == nil && r.msgName == msgName
+	})
+	c.Unlock()
+}
+
+// Use adds middlewares of handlers. They are called in order
+// of adding, the first one is the outermost.
+func (c *Client) Use(mw ...Middleware) {
+	c.Lock()
+	c.middleware = append(c.middleware, mw...)
+	c.Unlock()
+}
+
+// Intercept adds interceptors of outbound messages: sends,
+// requests and answers of handlers.
+func (c *Client) Intercept(i ...Interceptor) {
+	c.Lock()
+	c.interceptors = append(c.interceptors, i...)
 	c.Unlock()
 }
 
+func (c *Client) addRule(rule Rule) *Subscription {
+	r := &rule
+	r.id = nextRuleID()
+	c.Lock()
+	c.rules.add(r)
+	c.Unlock()
+
+	return &Subscription{unsubscribe: func() {
+		c.Lock()
+		c.rules.removeRule(r)
+		c.Unlock()
+	}}
+}
+
+// Flush waits until queued messages are written, see Batch.
+func (c *Client) Flush(ctx context.Context) error {
+	c.RLock()
+	out := c.out
+	c.RUnlock()
+	if out == nil {
+		return nil
+	}
+	return out.flush(ctx)
+}
+
+// Stats returns snapshot of handlers execution.
+func (c *Client) Stats() DispatchStats {
+	return c.workers.stats()
+}
+
+// Send ping while connection is alive.
+func (c *Client) ping(stream Conn) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.stream != stream || c.state != StateConnected {
+		return ErrDisconnected
+	}
+	return c.writeFrame(BID12(), 0, pingName, nil, nil)
+}
+
+// Pass outbound message through interceptors.
+func (c *Client) intercept(msg *Msg) error {
+	c.RLock()
+	interceptors := c.interceptors
+	c.RUnlock()
+	return intercept(msg, interceptors)
+}
+
+// Pass error to ErrorHandler.
+func (c *Client) reportErr(err error) {
+	if c.ErrorHandler != nil {
+		c.ErrorHandler("server", err)
+	}
+}
+
+// OnState subscribes on connection state changes.
+func (c *Client) OnState(h func(state ClientState)) {
+	c.Lock()
+	c.stateRules = append(c.stateRules, h)
+	c.Unlock()
+}
+
+// State returns current connection state.
+func (c *Client) State() ClientState {
+	c.RLock()
+	defer c.RUnlock()
+	return c.state
+}
+
 // Disconnect - close connection.
 func (c *Client) Disconnect() error {
 	c.Lock()
 	c.ID = ""
-	err := c.stream.Close()
+	c.closed = true
+	c.queue = nil
+	c.groups = nil
+	c.failPending()
+	var err error
+	if c.stream != nil {
+		err = c.stream.Close()
+	}
 	c.Unlock()
+
+	c.setState(StateClosed)
 	return err
 }
 
-func (c *Client) handleResponses() {
-	readStream("server", c.stream, func(msg Msg) bool {
-		c.Lock()
-		// Find handler
-		for i := range c.rules {
-			r := &c.rules[i]
-			matched := true
-			if r.msgID != nil {
-				matched = matched && BinEq(r.msgID, msg.ID)
+// Dial, start reading and handshake with server.
+func (c *Client) connect() error {
+	var stream Conn
+	var err error
+	if c.TLSConfig != nil {
+		stream, err = DialTLS(c.address, c.TLSConfig)
+	} else {
+		stream, err = Dial(c.address)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.stream = stream
+	c.workers.limit(c.QueueSize, c.Workers)
+	inflight := inFlight(c.MaxInFlight)
+	reader := &deadlineReader{conn: stream}
+	reader.setTimeout(c.IdleTimeout, nil)
+	c.Unlock()
+
+	// Start msg listener, done is closed when stream is lost
+	done := make(chan struct{})
+	go c.handleResponses(stream, reader, inflight, done)
+
+	// Handshake (sync)
+	err = c.handshake(stream, c.name)
+	if err != nil {
+		stream.Close()
+		return err
+	}
+
+	// Write queued messages and mark connection as ready. Stream
+	// lost before it is not restored by listener, so attempt fails.
+	c.Lock()
+	select {
+	case <-done:
+		c.Unlock()
+		return ErrDisconnected
+	default:
+	}
+	if c.closed {
+		c.Unlock()
+		stream.Close()
+		return ErrDisconnected
+	}
+	if c.Batch != nil {
+		c.out = newWriter(stream, 0, WriteBlock, 0, c.Batch)
+	}
+	if c.Heartbeat != nil && c.Heartbeat.Interval > 0 && hasFeature(c.Features, FeatureHeartbeat) {
+		reader.setTimeout(c.IdleTimeout, c.Heartbeat)
+		go sendPings(c.Heartbeat.Interval, nil, func() error {
+			return c.ping(stream)
+		})
+	}
+	err = c.rejoin()
+	if err == nil {
+		err = c.flushQueue()
+	}
+	if err != nil {
+		c.Unlock()
+		stream.Close()
+		return err
+	}
+	handlers := c.swapState(StateConnected)
+	c.Unlock()
+	notifyState(handlers, StateConnected)
+
+	return nil
+}
+
+func (c *Client) handleResponses(stream Conn, reader *deadlineReader, inflight chan struct{}, done chan struct{}) {
+	d := NewDecoder(reader)
+	d.MaxNameLen = c.MaxNameLen
+	d.MaxBodySize = c.MaxBodySize
+	d.Borrow = c.BorrowBodies
+	var borrowed *sync.WaitGroup
+	if d.Borrow {
+		borrowed = &sync.WaitGroup{}
+	}
+	err := readStream("server", d, func(msg Msg) bool {
+		c.dispatch(stream, inflight, msg, borrowed)
+		if borrowed != nil {
+			borrowed.Wait()
+		}
+		return true
+	})
+	d.Release()
+
+	// Report protocol error to server and close connection
+	var protoErr *ProtocolError
+	if errors.As(err, &protoErr) {
+		stream.SetWriteDeadline(time.Now().Add(time.Second))
+		stream.Write(protocolErrFrame(err))
+		stream.Close()
+		c.reportErr(err)
+	}
+	stream.Close()
+	close(done)
+	c.dispatch(stream, inflight, disconnectMsg("server"), nil)
+
+	// Connection lost, try to restore it. Failures during
+	// connecting are handled by the connect caller.
+	c.Lock()
+	if c.stream == stream {
+		c.failPending()
+		if c.out != nil {
+			c.out.stop()
+			c.out = nil
+		}
+	}
+	if c.stream != stream || c.closed || c.state != StateConnected {
+		c.Unlock()
+		return
+	}
+	c.ID = ""
+	state := StateReconnecting
+	if c.Reconnect == nil {
+		state = StateClosed
+		c.closed = true
+	}
+	handlers := c.swapState(state)
+	c.Unlock()
+	notifyState(handlers, state)
+
+	if state == StateReconnecting {
+		go c.reconnect()
+	}
+}
+
+// Find handlers for message and start them. Borrowed message
+// is valid until handlers added to borrowed are done.
+func (c *Client) dispatch(stream Conn, inflight chan struct{}, msg Msg, borrowed *sync.WaitGroup) {
+	c.Lock()
+	// Answer for pending request
+	if ch, ok := c.pending[string(msg.ID)]; ok {
+		delete(c.pending, string(msg.ID))
+		if borrowed != nil {
+			msg = msg.copy()
+		}
+		ch <- msg
+		c.Unlock()
+		return
+	}
+
+	// Heartbeats
+	switch msg.Name {
+	case pingName:
+		c.writeTo(stream, BID12(), 0, pongName, nil, nil)
+		c.Unlock()
+		return
+	case pongName, joinName, leaveName, helloName:
+		c.Unlock()
+		return
+	case protocolErrorName:
+		c.Unlock()
+		c.reportErr(msg.Err())
+		return
+	}
+
+	// Find handlers
+	var matched []*Rule
+	for _, r := range c.rules.lookup(msg.Name) {
+		if r.matchID(msg) && r.take() {
+			matched = append(matched, r)
+			if r.once {
+				c.rules.removeRule(r)
 			}
-			if r.msgName != "" {
-				matched = matched && r.msgName == msg.Name
+		}
+	}
+
+	// Nobody will answer the request
+	if len(matched) == 0 && msg.Meta&MsgReq == MsgReq {
+		c.writeErr(stream, msg, &RemoteError{
+			Code:    CodeNoHandler,
+			Message: "no handler for " + msg.Name,
+		})
+	}
+	key := c.Dispatch.key(msg.Author, msg.Name)
+	middleware := c.middleware
+	c.Unlock()
+
+	// Start handlers, queue is filled without lock as handlers
+	// may need it
+	for _, r := range matched {
+		r := r
+		msg := msg
+		if borrowed != nil {
+			// Answers of Req are passed to caller
+			if r.internal {
+				msg = msg.copy()
 			}
-			if matched {
-				// Call it and remove if needed
-				handler := r.handler
-				if r.once {
-					if !r.called {
-						go handler(msg)
-						r.called = true
-					}
-				} else {
-					go handler(msg)
-				}
+			borrowed.Add(1)
+		}
+		c.workers.acquire(inflight)
+		c.workers.run(key, func() {
+			defer c.workers.release(inflight)
+			if borrowed != nil {
+				defer borrowed.Done()
 			}
+			c.handleMessage(msg, r, stream, middleware)
+		})
+	}
+}
+
+// Call handler and write its answer if message is request.
+func (c *Client) handleMessage(msg Msg, rule *Rule, stream Conn, middleware []Middleware) {
+	handler := rule.handler
+	if !rule.internal {
+		handler = chain(handler, middleware)
+	}
+	ans, err := handler.safeCall(msg)
+	answer := Msg{ID: msg.ID, Name: msg.Name, Body: ans}
+	if err == nil && !rule.internal && msg.Meta&MsgReq == MsgReq {
+		err = safeRun(func() error { return c.intercept(&answer) })
+	}
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		c.reportErr(err)
+	}
+	if msg.Meta&MsgReq != MsgReq {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if err != nil {
+		c.writeErr(stream, msg, err)
+		return
+	}
+
+	var meta byte
+	if answer.Body != nil {
+		meta = MsgWithBody
+	}
+	var id [12]byte
+	copy(id[:], msg.ID)
+	c.writeTo(stream, id, meta, answer.Name, answer.Headers, answer.Body)
+}
+
+// Try to restore connection with backoff.
+func (c *Client) reconnect() {
+	opts := c.Reconnect
+	for attempt := 0; opts.MaxAttempts == 0 || attempt < opts.MaxAttempts; attempt++ {
+		<-time.After(opts.delay(attempt))
+
+		c.RLock()
+		closed := c.closed
+		c.RUnlock()
+		if closed {
+			return
 		}
-		c.Unlock()
 
-		return true
-	})
+		if c.connect() == nil {
+			return
+		}
+	}
+
+	// Give up
+	c.Lock()
+	c.closed = true
+	c.queue = nil
+	c.failPending()
+	c.Unlock()
+	c.setState(StateClosed)
 }
 
 // Handshake with server
-func (c *Client) handshake(name string) error {
+func (c *Client) handshake(stream Conn, name string) error {
 	id := BID12()
-	err := writeMsg(c.stream, id, MsgWithBody|MsgReq, "handshake", []byte(name))
+
+	hello := encodeHandshake(handshakeInfo{
+		version:     ProtocolVersion,
+		minVersion:  c.MinVersion,
+		features:    Features,
+		credentials: c.Credentials,
+	}, true)
+
+	c.Lock()
+	ch := c.addPending(id)
+	err := writeMsg(stream, BID12(), MsgWithBody, helloName, hello)
+	if err == nil {
+		err = writeMsg(stream, id, MsgWithBody|MsgReq, "handshake", []byte(name))
+	}
+	c.Unlock()
+	if err != nil {
+		c.Lock()
+		c.removePending(id)
+		c.Unlock()
+		return err
+	}
+
+	// Wait for answer
+	msg, err := c.wait(context.Background(), id, ch)
+	if err != nil {
+		return err
+	}
+	if err = msg.Err(); err != nil {
+		return err
+	}
+
+	// Check agreed version
+	info, err := decodeHandshake(msg.Body, false)
 	if err != nil {
 		return err
 	}
+	if info.version < c.MinVersion || info.version > ProtocolVersion {
+		return ErrIncompatible
+	}
+
+	c.Lock()
+	c.ID = info.value
+	c.Version = info.version
+	c.Features = info.features
+	c.Unlock()
+	return nil
+}
+
+// Register pending request.
+// Should be called under lock.
+func (c *Client) addPending(id [12]byte) chan Msg {
+	if c.pending == nil {
+		c.pending = make(map[string]chan Msg)
+	}
+	ch := make(chan Msg, 1)
+	c.pending[string(id[:])] = ch
+	return ch
+}
 
-	// Listen for answer
-	readStream("server", c.stream, func(msg Msg) bool {
-		// Skip non-handshake responses
-		if msg.Name != "handshake" {
-			return true
+// Remove pending request.
+// Should be called under lock.
+func (c *Client) removePending(id [12]byte) {
+	delete(c.pending, string(id[:]))
+}
+
+// Close pending requests, so they get ErrDisconnected. Requests
+// which frames are queued for reconnection are kept.
+// Should be called under lock.
+func (c *Client) failPending() {
+	queued := make(map[string]bool, len(c.queue))
+	for _, m := range c.queue {
+		queued[string(m.id[:])] = true
+	}
+	for id, ch := range c.pending {
+		if !queued[id] {
+			close(ch)
+			delete(c.pending, id)
 		}
+	}
+}
 
+// Wait for answer of pending request.
+func (c *Client) wait(ctx context.Context, id [12]byte, ch chan Msg) (Msg, error) {
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return Msg{}, ErrDisconnected
+		}
+		return msg, nil
+	case <-ctx.Done():
 		c.Lock()
-		c.ID = string(msg.Body)
+		c.removePending(id)
 		c.Unlock()
-		return false
-	})
+		return Msg{}, ctx.Err()
+	}
+}
 
+// Check if message can be written (or queued) now.
+// Should be called under lock.
+func (c *Client) writable() error {
+	switch c.state {
+	case StateConnected:
+		return nil
+	case StateReconnecting, StateConnecting:
+		if c.Reconnect == nil || c.closed {
+			return ErrDisconnected
+		}
+		if c.Reconnect.Policy == FailFast {
+			return ErrReconnecting
+		}
+		if c.Reconnect.QueueSize > 0 && len(c.queue) >= c.Reconnect.QueueSize {
+			return ErrQueueFull
+		}
+		return nil
+	default:
+		return ErrDisconnected
+	}
+}
+
+// Write message or queue it while reconnecting.
+// Should be called under lock.
+func (c *Client) write(id [12]byte, meta byte, name string, headers Headers, body []byte) error {
+	err := c.writable()
+	if err != nil {
+		return err
+	}
+	if len(name) > 255 {
+		return ErrNameTooLong
+	}
+	if err = checkHeaders(headers); err != nil {
+		return err
+	}
+
+	if c.state != StateConnected {
+		// Body can be borrowed or reused by caller
+		body = append([]byte(nil), body...)
+		c.queue = append(c.queue, queuedMsg{id, meta, name, headers, body})
+		return nil
+	}
+
+	return c.writeFrame(id, meta, name, headers, body)
+}
+
+// Write message, headers are dropped if server does not
+// support them. Should be called under lock.
+func (c *Client) writeFrame(id [12]byte, meta byte, name string, headers Headers, body []byte) error {
+	if !hasFeature(c.Features, FeatureHeaders) {
+		headers = nil
+	}
+	if c.out != nil {
+		return c.out.writeFrame(id, meta, name, headers, body)
+	}
+	return writeFrame(c.stream, id, meta, name, headers, body)
+}
+
+// Write message to connection if it is still current, e.g.
+// answer to request received from it. Should be called under lock.
+func (c *Client) writeTo(stream Conn, id [12]byte, meta byte, name string, headers Headers, body []byte) error {
+	if c.stream != stream {
+		return ErrDisconnected
+	}
+	return c.writeFrame(id, meta, name, headers, body)
+}
+
+// Write error response for request.
+// Should be called under lock.
+func (c *Client) writeErr(stream Conn, msg Msg, err error) error {
+	var id [12]byte
+	copy(id[:], msg.ID)
+	return c.writeTo(stream, id, MsgWithBody|MsgErr, msg.Name, nil, encodeRemoteError(err))
+}
+
+// Write queued messages after reconnection.
+// Should be called under lock.
+func (c *Client) flushQueue() error {
+	for len(c.queue) > 0 {
+		m := c.queue[0]
+		err := c.writeFrame(m.id, m.meta, m.name, m.headers, m.body)
+		if err != nil {
+			return err
+		}
+		c.queue = c.queue[1:]
+	}
+	c.queue = nil
 	return nil
 }
+
+// Update state and notify subscribers.
+func (c *Client) setState(state ClientState) {
+	c.Lock()
+	handlers := c.swapState(state)
+	c.Unlock()
+	notifyState(handlers, state)
+}
+
+// Update state and return subscribers that should be
+// notified. Should be called under lock.
+func (c *Client) swapState(state ClientState) []func(state ClientState) {
+	if c.state == state {
+		return nil
+	}
+	c.state = state
+	handlers := make([]func(state ClientState), len(c.stateRules))
+	copy(handlers, c.stateRules)
+	return handlers
+}
+
+func notifyState(handlers []func(state ClientState), state ClientState) {
+	for _, h := range handlers {
+		h(state)
+	}
+}
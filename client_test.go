@@ -0,0 +1,61 @@
+package con
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequest(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{}
+	release := make(chan struct{})
+	server.On("", "echo", func(msg Msg) (ans []byte) {
+		return msg.Body
+	})
+	server.On("", "slow", func(msg Msg) (ans []byte) {
+		<-release
+		return []byte("late")
+	})
+	server.On("", "drop", func(msg Msg) (ans []byte) {
+		server.Disconnect(msg.Author)
+		return
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	defer close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{}
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Answer
+	ans, err := client.Request(context.Background(), "echo", []byte("hello"))
+	if err != nil || string(ans.Body) != "hello" {
+		t.Errorf("Unexpected answer: %q, %v", ans.Body, err)
+	}
+
+	// Deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.Request(ctx, "slow", nil); err != context.DeadlineExceeded {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Request is not canceled in time: %s", d)
+	}
+	client.Lock()
+	if len(client.pending) != 0 {
+		t.Errorf("Pending requests are left: %d", len(client.pending))
+	}
+	client.Unlock()
+
+	// Stream drop
+	if _, err := client.Request(context.Background(), "drop", nil); err != ErrDisconnected {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
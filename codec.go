@@ -0,0 +1,92 @@
+package con
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+)
+
+// Codec - marshaling of typed message bodies.
+type Codec interface {
+	// ContentType returns name of codec, e.g. "application/json".
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Built-in codecs
+var (
+	JSON Codec = jsonCodec{}
+	Gob  Codec = gobCodec{}
+)
+
+// DefaultCodec is used by Client and Server without Codec.
+var DefaultCodec = JSON
+
+var codecs = struct {
+	sync.RWMutex
+	byType map[string]Codec
+}{
+	byType: map[string]Codec{
+		JSON.ContentType(): JSON,
+		Gob.ContentType():  Gob,
+	},
+}
+
+// RegisterCodec makes codec available for decoding messages
+// with its content type.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	codecs.byType[c.ContentType()] = c
+	codecs.Unlock()
+}
+
+// CodecFor returns registered codec by content type.
+func CodecFor(contentType string) (Codec, bool) {
+	codecs.RLock()
+	c, ok := codecs.byType[contentType]
+	codecs.RUnlock()
+	return c, ok
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Get codec or default one.
+func codecOr(c Codec) Codec {
+	if c == nil {
+		return DefaultCodec
+	}
+	return c
+}
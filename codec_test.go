@@ -0,0 +1,99 @@
+package con
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type testPayload struct {
+	Name  string
+	Count int
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []Codec{JSON, Gob} {
+		in := testPayload{Name: "Test", Count: 3}
+		data, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: cannot marshal: %v", codec.ContentType(), err)
+		}
+
+		var out testPayload
+		err = codec.Unmarshal(data, &out)
+		if err != nil {
+			t.Fatalf("%s: cannot unmarshal: %v", codec.ContentType(), err)
+		}
+		if out != in {
+			t.Errorf("%s: unexpected output: %+v", codec.ContentType(), out)
+		}
+
+		if c, ok := CodecFor(codec.ContentType()); !ok || c != codec {
+			t.Errorf("%s: codec is not registered", codec.ContentType())
+		}
+	}
+}
+
+func TestTypedMessages(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{Codec: JSON}
+	OnTyped(&server, "", "double", func(v testPayload) (testPayload, error) {
+		v.Count *= 2
+		return v, nil
+	})
+	notes := make(chan testPayload, 1)
+	OnTyped(&server, "", "note", func(v testPayload) (struct{}, error) {
+		notes <- v
+		return struct{}{}, nil
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{Codec: Gob}
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Gob request is decoded by header, answer is decoded by
+	// its own header
+	out, err := RequestTyped[testPayload, testPayload](ctx, &client, "double", testPayload{Name: "Test", Count: 3})
+	if err != nil || out != (testPayload{Name: "Test", Count: 6}) {
+		t.Errorf("Unexpected answer: %+v, %v", out, err)
+	}
+
+	// Answer carries content type of server codec
+	body, _ := Gob.Marshal(testPayload{Count: 1})
+	ans, err := client.RequestMsg(ctx, Msg{
+		Name:    "double",
+		Headers: Headers{HeaderContentType: Gob.ContentType()},
+		Body:    body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := ans.Headers[HeaderContentType]; ct != JSON.ContentType() {
+		t.Errorf("Wrong content type of answer: %q", ct)
+	}
+	var decoded testPayload
+	if err := json.Unmarshal(ans.Body, &decoded); err != nil || decoded.Count != 2 {
+		t.Errorf("Answer is not encoded by server codec: %q, %v", ans.Body, err)
+	}
+
+	// Message without answer
+	if err := SendTyped(&client, "note", testPayload{Name: "Note"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-notes:
+		if v.Name != "Note" {
+			t.Errorf("Unexpected message: %+v", v)
+		}
+	case <-time.After(time.Second):
+		t.Error("Typed message is not handled")
+	}
+}
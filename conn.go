@@ -1,6 +1,7 @@
 package con
 
 import (
+	"crypto/tls"
 	"net"
 	"strings"
 	"time"
@@ -35,3 +36,46 @@ func Dial(address string) (c Conn, err error) {
 	}
 	return
 }
+
+// DialTLS dials tcp address and makes TLS handshake. Unix
+// sockets are dialed without TLS.
+func DialTLS(address string, config *tls.Config) (Conn, error) {
+	c, err := Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return c, nil
+	}
+
+	// Verify server name by host of address
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+
+	tlsConn := tls.Client(tcp, config)
+	err = tlsConn.Handshake()
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	return &TLSConn{tlsConn, tcp}, nil
+}
+
+// TLSConn - TLS connection over tcp.
+type TLSConn struct {
+	*tls.Conn
+	tcp *net.TCPConn
+}
+
+// SetReadBuffer sets size of receive buffer of tcp connection.
+func (c *TLSConn) SetReadBuffer(bytes int) error {
+	return c.tcp.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer sets size of transmit buffer of tcp connection.
+func (c *TLSConn) SetWriteBuffer(bytes int) error {
+	return c.tcp.SetWriteBuffer(bytes)
+}
@@ -0,0 +1,41 @@
+package con
+
+import "strings"
+
+// Reserved namespace of control messages. Peers can not send
+// messages with such names except of the known control frames.
+const controlPrefix = "$con."
+
+// EventDisconnect - name of message passed to handlers when
+// connection is lost.
+const EventDisconnect = controlPrefix + "disconnect"
+
+// EventGoodbye - name of message sent by server to clients on
+// Shutdown.
+const EventGoodbye = controlPrefix + "goodbye"
+
+// Control messages, they are not passed to handlers.
+const (
+	pingName          = controlPrefix + "ping"
+	pongName          = controlPrefix + "pong"
+	protocolErrorName = controlPrefix + "protocol-error"
+	joinName          = controlPrefix + "join"
+	leaveName         = controlPrefix + "leave"
+	helloName         = controlPrefix + "hello"
+)
+
+// Control messages which peer can send.
+var peerControl = map[string]bool{
+	pingName:          true,
+	pongName:          true,
+	protocolErrorName: true,
+	joinName:          true,
+	leaveName:         true,
+	helloName:         true,
+	EventGoodbye:      true,
+}
+
+// Check if message from peer uses reserved name.
+func spoofed(name string) bool {
+	return strings.HasPrefix(name, controlPrefix) && !peerControl[name]
+}
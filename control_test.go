@@ -0,0 +1,49 @@
+package con
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestSpoofed(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"disconnect":      false,
+		EventDisconnect:   true,
+		controlPrefix:     true,
+		pingName:          false,
+		pongName:          false,
+		"$con":            false,
+		"orders.$con.new": false,
+	} {
+		if spoofed(name) != expected {
+			t.Errorf("Unexpected spoofed(%q): %v", name, !expected)
+		}
+	}
+}
+
+func TestDisconnectReason(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}
+	protoErr := &ProtocolError{ErrFrameTooLarge}
+	reset := errors.New("connection reset by peer")
+
+	cases := []struct {
+		err       error
+		heartbeat bool
+		reason    error
+	}{
+		{nil, false, io.EOF},
+		{io.EOF, true, io.EOF},
+		{timeout, true, ErrHeartbeatTimeout},
+		{timeout, false, ErrIdleTimeout},
+		{protoErr, false, protoErr},
+		{reset, false, reset},
+	}
+	for _, c := range cases {
+		if r := disconnectReason(c.err, c.heartbeat); r != c.reason {
+			t.Errorf("Unexpected reason of %v: %v", c.err, r)
+		}
+	}
+}
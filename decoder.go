@@ -0,0 +1,270 @@
+package con
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+)
+
+// DefaultReadSize - size of read buffer of Decoder.
+const DefaultReadSize = 4096
+
+// DefaultMaxBodySize - max size of message body.
+const DefaultMaxBodySize = 4 << 20
+
+// Max size of buffer allocated before data arrives. Larger
+// sections are read into growing buffer, so peer can not make
+// decoder allocate declared size without sending it.
+const maxPrealloc = 64 << 10
+
+// Max number of cached message names of decoder.
+const maxCachedNames = 256
+
+// Max capacity of body buffer returned to pool.
+const maxPooledBody = 1 << 20
+
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, DefaultReadSize)
+	},
+}
+
+var bodyPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, DefaultReadSize)
+		return &b
+	},
+}
+
+// Decoder reads messages from stream of con frames. Buffers are
+// reused between messages, call Release when decoder is not
+// needed anymore.
+type Decoder struct {
+	// Borrow - do not copy id and body of decoded message. They
+	// are valid only until the next call of Decode.
+	Borrow bool
+
+	// MaxNameLen - max length of message name, 0 - 255.
+	MaxNameLen int
+
+	// MaxBodySize - max size of message body and of headers
+	// section. 0 - DefaultMaxBodySize, negative - no limit.
+	MaxBodySize int
+
+	r      *bufio.Reader
+	pooled bool
+	head   [14]byte
+	body   *[]byte
+	names  map[string]string
+}
+
+// NewDecoder creates decoder with default read size.
+func NewDecoder(r io.Reader) *Decoder {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return &Decoder{r: br, pooled: true}
+}
+
+// NewDecoderSize creates decoder reading stream by chunks of
+// provided size (min 256 bytes).
+func NewDecoderSize(r io.Reader, size int) *Decoder {
+	if size == DefaultReadSize {
+		return NewDecoder(r)
+	}
+	if size < 256 {
+		size = 256
+	}
+	return &Decoder{r: bufio.NewReaderSize(r, size)}
+}
+
+// Decode reads the next message. Returns io.EOF if stream ends
+// between messages and io.ErrUnexpectedEOF inside of message.
+// Too large or malformed frames are reported as *ProtocolError,
+// the stream can not be decoded after it.
+func (d *Decoder) Decode() (Msg, error) {
+	var msg Msg
+
+	// Id, meta and name len
+	_, err := io.ReadFull(d.r, d.head[:])
+	if err != nil {
+		return msg, err
+	}
+	msg.Meta = d.head[12]
+
+	// Name
+	nameLen := int(d.head[13])
+	if d.MaxNameLen > 0 && nameLen > d.MaxNameLen {
+		return msg, &ProtocolError{ErrFrameTooLarge}
+	}
+	name, err := d.r.Peek(nameLen)
+	if err != nil {
+		return msg, unexpected(err)
+	}
+	msg.Name = d.name(name)
+	d.r.Discard(nameLen)
+
+	// Headers
+	if msg.Meta&MsgWithHeaders == MsgWithHeaders {
+		data, err := d.read(4)
+		if err != nil {
+			return msg, err
+		}
+		size, err := d.size(uint64(binary.BigEndian.Uint32(data)))
+		if err != nil {
+			return msg, err
+		}
+		data, err = d.read(size)
+		if err != nil {
+			return msg, err
+		}
+		msg.Headers, err = decodeHeaders(data)
+		if err != nil {
+			return msg, &ProtocolError{ErrBadFrame}
+		}
+	}
+
+	// Body
+	var bodyLen int
+	if msg.Meta&MsgWithBody == MsgWithBody {
+		data, err := d.read(8)
+		if err != nil {
+			return msg, err
+		}
+		bodyLen, err = d.size(binary.BigEndian.Uint64(data))
+		if err != nil {
+			return msg, err
+		}
+	}
+
+	// Id and body share one allocation, or the buffer when borrowed
+	var buf []byte
+	if d.Borrow {
+		buf = d.buffer(12)
+	} else {
+		prealloc := bodyLen
+		if prealloc > maxPrealloc {
+			prealloc = maxPrealloc
+		}
+		buf = make([]byte, 12, 12+prealloc)
+	}
+	copy(buf, d.head[:12])
+	buf, err = readAppend(d.r, buf, bodyLen)
+	if d.Borrow {
+		*d.body = buf
+	}
+	if err != nil {
+		return msg, err
+	}
+	msg.ID = buf[:12:12]
+	if bodyLen > 0 {
+		msg.Body = buf[12:]
+	}
+
+	return msg, nil
+}
+
+// Release returns buffers of decoder to pool. Decoder can not
+// be used after it.
+func (d *Decoder) Release() {
+	if d.pooled {
+		d.r.Reset(nil)
+		readerPool.Put(d.r)
+		d.pooled = false
+	}
+	d.r = nil
+	if d.body != nil && cap(*d.body) <= maxPooledBody {
+		bodyPool.Put(d.body)
+	}
+	d.body = nil
+}
+
+// Check size of section received from peer.
+func (d *Decoder) size(n uint64) (int, error) {
+	max := uint64(d.MaxBodySize)
+	switch {
+	case d.MaxBodySize == 0:
+		max = DefaultMaxBodySize
+	case d.MaxBodySize < 0:
+		max = math.MaxInt - 12
+	}
+	if n > max {
+		return 0, &ProtocolError{ErrFrameTooLarge}
+	}
+	return int(n), nil
+}
+
+// Read n bytes to internal buffer.
+func (d *Decoder) read(n int) ([]byte, error) {
+	buf, err := readAppend(d.r, d.buffer(0), n)
+	*d.body = buf
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Read n bytes and append them to buf. Buffer grows by chunks
+// as data arrives.
+func readAppend(r io.Reader, buf []byte, n int) ([]byte, error) {
+	for n > 0 {
+		if len(buf) == cap(buf) {
+			grow := cap(buf)
+			if grow < maxPrealloc {
+				grow = maxPrealloc
+			}
+			if grow > n {
+				grow = n
+			}
+			grown := make([]byte, len(buf), len(buf)+grow)
+			copy(grown, buf)
+			buf = grown
+		}
+		chunk := cap(buf) - len(buf)
+		if chunk > n {
+			chunk = n
+		}
+		read, err := io.ReadFull(r, buf[len(buf):len(buf)+chunk])
+		buf = buf[:len(buf)+read]
+		n -= read
+		if err != nil {
+			return buf, unexpected(err)
+		}
+	}
+	return buf, nil
+}
+
+// Get internal buffer of size n.
+func (d *Decoder) buffer(n int) []byte {
+	if d.body == nil {
+		d.body = bodyPool.Get().(*[]byte)
+	}
+	if cap(*d.body) < n {
+		*d.body = make([]byte, n)
+	}
+	return (*d.body)[:n]
+}
+
+// Get message name without allocation for repeated names.
+func (d *Decoder) name(b []byte) string {
+	if name, ok := d.names[string(b)]; ok {
+		return name
+	}
+	name := string(b)
+	if d.names == nil {
+		d.names = make(map[string]string)
+	}
+	if len(d.names) < maxCachedNames {
+		d.names[name] = name
+	}
+	return name
+}
+
+// Stream ended inside of message.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,260 @@
+package con
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDecoder(t *testing.T) {
+	var stream bytes.Buffer
+	id := BID12()
+	writeFrame(&stream, id, MsgWithBody|MsgReq, "first", Headers{"a": "b"}, []byte("body"))
+	writeMsg(&stream, id, 0, "second", nil)
+	writeMsg(&stream, id, MsgWithBody, "", make([]byte, 10000))
+
+	d := NewDecoderSize(&stream, 256)
+	defer d.Release()
+	msg, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !BinEq(msg.ID, id[:]) || msg.Meta != MsgWithBody|MsgReq|MsgWithHeaders {
+		t.Errorf("Unexpected id or meta: %v %x", msg.ID, msg.Meta)
+	}
+	if msg.Name != "first" || string(msg.Body) != "body" || msg.Headers["a"] != "b" {
+		t.Errorf("Unexpected first message: %+v", msg)
+	}
+
+	msg, err = d.Decode()
+	if err != nil || msg.Name != "second" || msg.Body != nil || msg.Headers != nil {
+		t.Errorf("Unexpected second message: %+v, %v", msg, err)
+	}
+
+	msg, err = d.Decode()
+	if err != nil || msg.Name != "" || len(msg.Body) != 10000 {
+		t.Errorf("Unexpected third message: %v, %v", len(msg.Body), err)
+	}
+
+	if _, err = d.Decode(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	var stream bytes.Buffer
+	writeMsg(&stream, BID12(), MsgWithBody, "msg", []byte("body"))
+	frame := stream.Bytes()
+
+	for _, n := range []int{5, 16, 20, len(frame) - 1} {
+		d := NewDecoder(bytes.NewReader(frame[:n]))
+		if _, err := d.Decode(); err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected ErrUnexpectedEOF for %d bytes, got %v", n, err)
+		}
+		d.Release()
+	}
+}
+
+func TestDecoderDeclaredSize(t *testing.T) {
+	// Frames which declare large body or headers and end
+	var stream bytes.Buffer
+	writeMsg(&stream, BID12(), MsgWithBody, "msg", nil)
+	body := append(append([]byte(nil), stream.Bytes()[:17]...), 0, 0, 0, 0, 0, 0x3f, 0xff, 0xff)
+	body[12] = MsgWithBody
+	stream.Reset()
+	writeFrame(&stream, BID12(), 0, "msg", Headers{"a": "b"}, nil)
+	headers := append(append([]byte(nil), stream.Bytes()[:17]...), 0, 0x3f, 0xff, 0xff)
+
+	for _, borrow := range []bool{false, true} {
+		for _, frame := range [][]byte{body, headers} {
+			d := NewDecoder(bytes.NewReader(frame))
+			d.Borrow = borrow
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := d.Decode()
+			runtime.ReadMemStats(&after)
+			d.Release()
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("Expected ErrUnexpectedEOF, got %v", err)
+			}
+			if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+				t.Errorf("Declared size is allocated: %d bytes", n)
+			}
+		}
+	}
+
+	// Large bodies are still read
+	stream.Reset()
+	large := bytes.Repeat([]byte("0123456789"), 300000)
+	writeMsg(&stream, BID12(), MsgWithBody, "large", large)
+	writeMsg(&stream, BID12(), MsgWithBody, "large", large)
+	for _, borrow := range []bool{false, true} {
+		d := NewDecoder(&stream)
+		d.Borrow = borrow
+		msg, err := d.Decode()
+		if err != nil || !bytes.Equal(msg.Body, large) {
+			t.Errorf("Large body is not decoded: %d bytes, %v", len(msg.Body), err)
+		}
+		d.Release()
+	}
+}
+
+func TestDecoderBorrow(t *testing.T) {
+	var stream bytes.Buffer
+	for i := 0; i < 100; i++ {
+		writeMsg(&stream, BID12(), MsgWithBody, "msg", []byte("body"))
+	}
+	frames := bytes.NewReader(stream.Bytes())
+	d := NewDecoder(frames)
+	d.Borrow = true
+	defer d.Release()
+
+	d.Decode()
+	allocs := testing.AllocsPerRun(50, func() {
+		msg, err := d.Decode()
+		if err != nil || string(msg.Body) != "body" {
+			t.Fatalf("Unexpected message: %+v, %v", msg, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations with borrowed body, got %v", allocs)
+	}
+}
+
+// Stream of the same frames.
+type repeatReader struct {
+	frames []byte
+	r      bytes.Reader
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	if r.r.Len() == 0 {
+		r.r.Reset(r.frames)
+	}
+	return r.r.Read(p)
+}
+
+func benchDecode(b *testing.B, borrow bool) {
+	var stream bytes.Buffer
+	for i := 0; i < 100; i++ {
+		writeMsg(&stream, BID12(), MsgWithBody, "repeat", []byte("small message body"))
+	}
+	d := NewDecoder(&repeatReader{frames: stream.Bytes()})
+	d.Borrow = borrow
+	defer d.Release()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Decode()
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	benchDecode(b, false)
+}
+
+func BenchmarkDecodeBorrow(b *testing.B) {
+	benchDecode(b, true)
+}
+
+func TestDecoderLimits(t *testing.T) {
+	var stream bytes.Buffer
+	writeMsg(&stream, BID12(), MsgWithBody, "long name", []byte("body"))
+	frame := stream.Bytes()
+
+	decode := func(nameLen int, bodySize int, frame []byte) error {
+		d := NewDecoder(bytes.NewReader(frame))
+		defer d.Release()
+		d.MaxNameLen = nameLen
+		d.MaxBodySize = bodySize
+		_, err := d.Decode()
+		return err
+	}
+
+	var protoErr *ProtocolError
+	if err := decode(4, 0, frame); !errors.As(err, &protoErr) || protoErr.Err != ErrFrameTooLarge {
+		t.Errorf("Expected too long name, got %v", err)
+	}
+	if err := decode(0, 3, frame); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected too large body, got %v", err)
+	}
+	if err := decode(9, 4, frame); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Body len from the wire is not trusted
+	huge := append([]byte(nil), frame[:23]...)
+	huge = append(huge, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	if err := decode(0, -1, huge); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected too large body, got %v", err)
+	}
+
+	// Malformed headers
+	stream.Reset()
+	writeFrame(&stream, BID12(), 0, "msg", Headers{"a": "b"}, nil)
+	bad := stream.Bytes()
+	bad[len(bad)-5] = 10
+	if err := decode(0, 0, bad); !errors.Is(err, ErrBadFrame) {
+		t.Errorf("Expected malformed frame, got %v", err)
+	}
+}
+
+func TestBorrowBodies(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{BorrowBodies: true}
+	bodies := make(chan string, 20)
+	server.On("", "msg", func(msg Msg) (ans []byte) {
+		// The next message is not read meanwhile
+		time.Sleep(time.Millisecond)
+		bodies <- string(msg.Body)
+		return
+	})
+	server.On("", "echo", func(msg Msg) (ans []byte) {
+		return msg.Body
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{BorrowBodies: true}
+	client.On("ask", func(msg Msg) (ans []byte) {
+		return append([]byte("answer-"), msg.Body...)
+	})
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for i := 0; i < 20; i++ {
+		client.Send("msg", []byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 20; i++ {
+		if body := <-bodies; body != strconv.Itoa(i) {
+			t.Errorf("Expected body %d, got %q", i, body)
+		}
+	}
+
+	// Answers are copied
+	ctx := context.Background()
+	first, err := client.Request(ctx, "echo", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Request(ctx, "echo", []byte("second"))
+	if string(first.Body) != "first" {
+		t.Errorf("Answer is overwritten: %q", first.Body)
+	}
+	first, err = server.Request(ctx, "client", "ask", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Request(ctx, "client", "ask", []byte("2"))
+	if string(first.Body) != "answer-1" {
+		t.Errorf("Answer is overwritten: %q", first.Body)
+	}
+}
@@ -0,0 +1,189 @@
+package con
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DispatchMode - how handlers of received messages are executed.
+type DispatchMode int
+
+const (
+	// DispatchConcurrent - each handler in its own goroutine.
+	DispatchConcurrent DispatchMode = iota
+
+	// DispatchPerClient - handlers of messages of one connection
+	// are executed one by one in order of receiving.
+	DispatchPerClient
+
+	// DispatchPerName - handlers of messages of one connection
+	// with the same name are executed one by one in order of
+	// receiving.
+	DispatchPerName
+)
+
+// DefaultQueueSize - size of handlers queue in ordered modes.
+const DefaultQueueSize = 64
+
+// DispatchStats - snapshot of handlers execution.
+type DispatchStats struct {
+	// Running - number of executing handlers.
+	Running int64
+
+	// Queued - number of handlers waiting for execution.
+	Queued int64
+
+	// Paused - number of connections which reading is paused
+	// because of Workers or MaxInFlight limits.
+	Paused int64
+}
+
+// Get queue key of handler. Empty - handler runs concurrently.
+func (m DispatchMode) key(clientID string, msgName string) string {
+	switch m {
+	case DispatchPerClient:
+		return clientID
+	case DispatchPerName:
+		return clientID + "\x00" + msgName
+	}
+	return ""
+}
+
+// Handlers executor: ordered queues and pool of workers. Each
+// queue has its own goroutine that exits when the queue is empty.
+type dispatcher struct {
+	sync.Mutex
+	queues map[string]*taskQueue
+	size   int
+	pool   chan struct{}
+	limits bool
+
+	running int64
+	queued  int64
+	paused  int64
+}
+
+type taskQueue struct {
+	tasks chan func()
+	n     int // queued and running tasks, under dispatcher lock
+}
+
+// Set size of queues and max number of running handlers, 0 -
+// unlimited. Limits are set only once.
+func (d *dispatcher) limit(queueSize int, workers int) {
+	d.Lock()
+	defer d.Unlock()
+	if d.limits {
+		return
+	}
+	d.limits = true
+	d.size = queueSize
+	if workers > 0 {
+		d.pool = make(chan struct{}, workers)
+	}
+}
+
+// Run task in queue with provided key. Empty key - run task in
+// new goroutine. Blocks while the queue or the pool is full.
+func (d *dispatcher) run(key string, task func()) {
+	atomic.AddInt64(&d.queued, 1)
+	if key == "" {
+		d.acquire(d.pool)
+		go d.exec(task)
+		return
+	}
+
+	d.Lock()
+	if d.queues == nil {
+		d.queues = make(map[string]*taskQueue)
+	}
+	q := d.queues[key]
+	if q == nil {
+		size := d.size
+		if size <= 0 {
+			size = DefaultQueueSize
+		}
+		q = &taskQueue{tasks: make(chan func(), size)}
+		d.queues[key] = q
+		go d.work(key, q)
+	}
+	q.n++
+	d.Unlock()
+
+	select {
+	case q.tasks <- task:
+	default:
+		atomic.AddInt64(&d.paused, 1)
+		q.tasks <- task
+		atomic.AddInt64(&d.paused, -1)
+	}
+}
+
+// Execute tasks of queue until it is empty.
+func (d *dispatcher) work(key string, q *taskQueue) {
+	for {
+		task := <-q.tasks
+		if d.pool != nil {
+			d.pool <- struct{}{}
+		}
+		d.exec(task)
+
+		d.Lock()
+		q.n--
+		if q.n == 0 {
+			delete(d.queues, key)
+			d.Unlock()
+			return
+		}
+		d.Unlock()
+	}
+}
+
+// Execute task holding slot of the pool.
+func (d *dispatcher) exec(task func()) {
+	atomic.AddInt64(&d.queued, -1)
+	atomic.AddInt64(&d.running, 1)
+	defer func() {
+		atomic.AddInt64(&d.running, -1)
+		d.release(d.pool)
+	}()
+	task()
+}
+
+// Take slot of semaphore, blocks while it is full. Nil - no limit.
+func (d *dispatcher) acquire(sem chan struct{}) {
+	if sem == nil {
+		return
+	}
+	select {
+	case sem <- struct{}{}:
+		return
+	default:
+	}
+	atomic.AddInt64(&d.paused, 1)
+	sem <- struct{}{}
+	atomic.AddInt64(&d.paused, -1)
+}
+
+// Free slot of semaphore.
+func (d *dispatcher) release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+func (d *dispatcher) stats() DispatchStats {
+	return DispatchStats{
+		Running: atomic.LoadInt64(&d.running),
+		Queued:  atomic.LoadInt64(&d.queued),
+		Paused:  atomic.LoadInt64(&d.paused),
+	}
+}
+
+// Make semaphore of in-flight handlers. 0 - no limit.
+func inFlight(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
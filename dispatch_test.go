@@ -0,0 +1,163 @@
+package con
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatchModeKey(t *testing.T) {
+	if k := DispatchConcurrent.key("a", "msg"); k != "" {
+		t.Errorf("Unexpected key of concurrent mode: %q", k)
+	}
+	if DispatchPerClient.key("a", "x") != DispatchPerClient.key("a", "y") {
+		t.Error("Messages of one client should share queue")
+	}
+	if DispatchPerName.key("a", "x") == DispatchPerName.key("a", "y") {
+		t.Error("Messages with different names should have own queues")
+	}
+	if DispatchPerName.key("a", "x") == DispatchPerName.key("b", "x") {
+		t.Error("Clients should have own queues")
+	}
+}
+
+func TestDispatcherOrder(t *testing.T) {
+	var d dispatcher
+	d.limit(4, 0)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	got := map[string][]int{}
+
+	for i := 0; i < 1000; i++ {
+		for _, key := range []string{"a", "b"} {
+			i, key := i, key
+			wg.Add(1)
+			d.run(key, func() {
+				lock.Lock()
+				got[key] = append(got[key], i)
+				lock.Unlock()
+				wg.Done()
+			})
+		}
+	}
+	wg.Wait()
+
+	for key, seq := range got {
+		for i := range seq {
+			if seq[i] != i {
+				t.Fatalf("Queue %q is out of order at %d: %d", key, i, seq[i])
+			}
+		}
+	}
+
+	// Workers exit with empty queues
+	for i := 0; ; i++ {
+		d.Lock()
+		n := len(d.queues)
+		d.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Workers of %d queues are still running", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcherPool(t *testing.T) {
+	var d dispatcher
+	d.limit(0, 2)
+	block := make(chan struct{})
+	done := make(chan struct{})
+
+	// Reader is paused on the third task
+	go func() {
+		for i := 0; i < 3; i++ {
+			d.run("", func() { <-block })
+		}
+		close(done)
+	}()
+
+	for i := 0; ; i++ {
+		st := d.stats()
+		if st.Running == 2 && st.Queued == 1 && st.Paused == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Unexpected stats: %+v", st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(block)
+	<-done
+	for i := 0; d.stats() != (DispatchStats{}); i++ {
+		if i == 100 {
+			t.Fatalf("Unexpected stats: %+v", d.stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{MaxInFlight: 2}
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	server.On("", "block", func(msg Msg) (ans []byte) {
+		started <- struct{}{}
+		<-release
+		return
+	})
+	marked := make(chan struct{}, 1)
+	server.On("", "mark", func(msg Msg) (ans []byte) {
+		marked <- struct{}{}
+		return
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{}
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	for i := 0; i < 5; i++ {
+		client.Send("block", nil)
+	}
+	client.Send("mark", nil)
+
+	// Reading is paused while limit of handlers is hit
+	time.Sleep(100 * time.Millisecond)
+	if n := len(started); n != 2 {
+		t.Errorf("Wrong number of started handlers: %d", n)
+	}
+	if paused := server.Stats().Paused; paused != 1 {
+		t.Errorf("Wrong number of paused connections: %d", paused)
+	}
+	select {
+	case <-marked:
+		t.Error("Message is read while reading is paused")
+	default:
+	}
+
+	// Reading is resumed
+	close(release)
+	select {
+	case <-marked:
+	case <-time.After(time.Second):
+		t.Fatal("Reading is not resumed")
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("Only %d handlers are started", i)
+		}
+	}
+	if paused := server.Stats().Paused; paused != 0 {
+		t.Errorf("Wrong number of paused connections: %d", paused)
+	}
+}
@@ -1,8 +1,110 @@
 package con
 
-import "errors"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
 
 // Con errors
 var (
 	ErrDisconnected = errors.New("disconnected")
+	ErrReconnecting = errors.New("reconnecting")
+	ErrQueueFull    = errors.New("queue is full")
+	ErrServerClosed = errors.New("server closed")
+	ErrBadHandshake = errors.New("malformed handshake")
+	ErrIncompatible = errors.New("incompatible protocol version")
+	ErrNoCert       = errors.New("client certificate required")
+	ErrNoClient     = errors.New("no such client")
+
+	ErrFrameTooLarge = errors.New("frame is too large")
+	ErrBadFrame      = errors.New("malformed frame")
+
+	ErrKicked           = errors.New("disconnected by server")
+	ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+	ErrIdleTimeout      = errors.New("idle timeout")
+
+	ErrCertNotVerified = errors.New("client certificates are not verified")
+
+	ErrNameTooLong   = errors.New("message name is longer than 255 bytes")
+	ErrHeaderTooLong = errors.New("header key is longer than 255 bytes or value is longer than 65535 bytes")
 )
+
+// Remote error codes
+const (
+	CodeHandlerFailed = uint16(1)
+	CodeNoHandler     = uint16(2)
+	CodeIncompatible  = uint16(3)
+	CodeAuthFailed    = uint16(4)
+	CodeProtocol      = uint16(5)
+)
+
+// ErrorHandler - hook for errors which can not be returned to
+// caller. ClientID is "server" on client side.
+type ErrorHandler func(clientID string, err error)
+
+// RemoteError - error returned by handler on the other side.
+type RemoteError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error %d: %s", e.Code, e.Message)
+}
+
+// ProtocolError - peer sent too large or malformed frame.
+// Connection is closed after it.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError - recovered panic of handler. Requester gets it as
+// error response, ErrorHandler gets it with the stack.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in handler: %v", e.Value)
+}
+
+// Error after which connection should be closed.
+type fatalError struct {
+	error
+}
+
+func (e fatalError) Unwrap() error {
+	return e.error
+}
+
+// Encode error to body of error response: 2-bytes code + message.
+func encodeRemoteError(err error) []byte {
+	var re *RemoteError
+	if !errors.As(err, &re) {
+		re = &RemoteError{Code: CodeHandlerFailed, Message: err.Error()}
+	}
+	body := make([]byte, 2, 2+len(re.Message))
+	binary.BigEndian.PutUint16(body, re.Code)
+	return append(body, re.Message...)
+}
+
+// Decode body of error response.
+func decodeRemoteError(body []byte) *RemoteError {
+	if len(body) < 2 {
+		return &RemoteError{Code: CodeHandlerFailed}
+	}
+	return &RemoteError{
+		Code:    binary.BigEndian.Uint16(body),
+		Message: string(body[2:]),
+	}
+}
@@ -0,0 +1,122 @@
+package con
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRemoteErrorEncoding(t *testing.T) {
+	err := decodeRemoteError(encodeRemoteError(&RemoteError{Code: 7, Message: "Bad thing"}))
+	if err.Code != 7 || err.Message != "Bad thing" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Plain errors
+	err = decodeRemoteError(encodeRemoteError(errors.New("Oops")))
+	if err.Code != CodeHandlerFailed || err.Message != "Oops" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Error response
+	msg := Msg{Meta: MsgWithBody | MsgErr, Body: encodeRemoteError(err)}
+	var re *RemoteError
+	if !errors.As(msg.Err(), &re) {
+		t.Error("Error response should return *RemoteError")
+	}
+	if (Msg{Meta: MsgWithBody}).Err() != nil {
+		t.Error("Regular message should not return error")
+	}
+}
+
+func TestPanicError(t *testing.T) {
+	var h ErrHandler = func(msg Msg) ([]byte, error) {
+		panic("boom")
+	}
+	_, err := h.safeCall(Msg{})
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("Wrong error: %v", err)
+	}
+	if panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Errorf("Wrong panic: %v, stack %d bytes", panicErr.Value, len(panicErr.Stack))
+	}
+	if re := decodeRemoteError(encodeRemoteError(err)); re.Code != CodeHandlerFailed || re.Message != err.Error() {
+		t.Errorf("Wrong response: %v", re)
+	}
+}
+
+func TestPanicRecovered(t *testing.T) {
+	panics := make(chan interface{}, 10)
+	onErr := func(author string, err error) {
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			panics <- panicErr.Value
+		}
+	}
+
+	addr := testTCPAddr(t)
+	server := Server{
+		ErrorHandler: onErr,
+		AuthorizeJoin: func(c ConnectedClient, group string) error {
+			panic("join")
+		},
+	}
+	server.OnConnect(func(c ConnectedClient) { panic("connect") })
+	server.OnHandshake(func(c ConnectedClient) { panic("handshake") })
+	server.OnDisconnect(func(c ConnectedClient, reason error) { panic("disconnect") })
+	server.Intercept(func(msg *Msg) error {
+		if msg.Name == "ping" {
+			panic("server answer")
+		}
+		return nil
+	})
+	server.On("", "ping", func(msg Msg) (ans []byte) {
+		return []byte("pong")
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{ErrorHandler: onErr}
+	client.Intercept(func(msg *Msg) error {
+		if msg.Name == "echo" {
+			panic("client answer")
+		}
+		return nil
+	})
+	client.On("echo", func(msg Msg) (ans []byte) {
+		return msg.Body
+	})
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var re *RemoteError
+	if _, err := client.Request(ctx, "ping", nil); !errors.As(err, &re) {
+		t.Errorf("Wrong error of answer: %v", err)
+	}
+	if err := client.Join(ctx, "group"); !errors.As(err, &re) {
+		t.Errorf("Wrong error of join: %v", err)
+	}
+	if _, err := server.Request(ctx, "client", "echo", nil); !errors.As(err, &re) {
+		t.Errorf("Wrong error of client answer: %v", err)
+	}
+	client.Disconnect()
+
+	expected := map[interface{}]bool{
+		"connect": true, "handshake": true, "disconnect": true,
+		"join": true, "server answer": true, "client answer": true,
+	}
+	for len(expected) > 0 {
+		select {
+		case v := <-panics:
+			delete(expected, v)
+		case <-time.After(time.Second):
+			t.Fatalf("Panics are not reported: %v", expected)
+		}
+	}
+}
@@ -17,7 +17,7 @@ func main() {
 		log.Fatal("Cannot connect to server:\n    ", err)
 	}
 
-	client.On("disconnect", func(msg con.Msg) (ans []byte) {
+	client.On(con.EventDisconnect, func(msg con.Msg) (ans []byte) {
 		fmt.Println(" → DISCOnnect (simple on)")
 		return
 	})
@@ -2,6 +2,7 @@ package main
 
 import (
 	con "con/con-go"
+	"context"
 	"fmt"
 	"log"
 	"strconv"
@@ -11,7 +12,8 @@ import (
 func main() {
 	fmt.Println(" → Client 'C'")
 
-	client := con.Client{}
+	// Coalesce small messages into batched writes
+	client := con.Client{Batch: &con.BatchOptions{}}
 	// err := client.Connect("/tmp/con-examples.sock", "client-c")
 	err := client.Connect("127.0.0.1:1234", "client-c")
 	if err != nil {
@@ -33,6 +35,7 @@ func main() {
 		// <-answers[i]
 		// time.Sleep(1 * time.Microsecond)
 	}
+	client.Flush(context.Background())
 	endTS := time.Now()
 	fmt.Println(" → ", endTS.Sub(startTS))
 
@@ -0,0 +1,155 @@
+package con
+
+import (
+	"context"
+	"errors"
+)
+
+// Join adds clients with provided id or name to group. Client
+// leaves all groups when it disconnects.
+func (s *Server) Join(client string, group string) error {
+	s.Lock()
+	defer s.Unlock()
+	found := false
+	for _, c := range s.Clients {
+		if c.ID == client || c.Name == client {
+			c.join(group)
+			found = true
+		}
+	}
+	if !found {
+		return ErrNoClient
+	}
+	return nil
+}
+
+// Leave removes clients with provided id or name from group.
+func (s *Server) Leave(client string, group string) error {
+	s.Lock()
+	defer s.Unlock()
+	found := false
+	for _, c := range s.Clients {
+		if c.ID == client || c.Name == client {
+			delete(c.groups, group)
+			found = true
+		}
+	}
+	if !found {
+		return ErrNoClient
+	}
+	return nil
+}
+
+// BroadcastTo sends message to all clients of group.
+func (s *Server) BroadcastTo(group string, msgName string, body []byte) error {
+	return s.BroadcastToMsg(group, Msg{Name: msgName, Body: body})
+}
+
+// BroadcastToMsg sends message with headers to all clients of
+// group.
+func (s *Server) BroadcastToMsg(group string, msg Msg) error {
+	return s.sendTo(func(c *ConnectedClient) bool {
+		return c.groups[group]
+	}, msg)
+}
+
+// BroadcastExcept sends message to all clients of group except
+// one with senderID, e.g. to forward message of client to the
+// others. Empty group - all connected clients.
+func (s *Server) BroadcastExcept(senderID string, group string, msgName string, body []byte) error {
+	return s.sendTo(func(c *ConnectedClient) bool {
+		return c.ID != senderID && (group == "" || c.groups[group])
+	}, Msg{Name: msgName, Body: body})
+}
+
+// Handle request of client to join or leave group.
+func (s *Server) groupRequest(clientID string, msg Msg, out *writer) {
+	group := string(msg.Body)
+	var err error
+	if msg.Name == joinName && s.AuthorizeJoin != nil {
+		s.RLock()
+		var client ConnectedClient
+		if c := s.client(clientID); c != nil {
+			client = *c
+		}
+		s.RUnlock()
+		err = safeRun(func() error { return s.AuthorizeJoin(client, group) })
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			s.reportErr(clientID, err)
+		}
+	}
+
+	if err == nil {
+		s.Lock()
+		c := s.client(clientID)
+		switch {
+		case c == nil:
+			err = ErrDisconnected
+		case msg.Name == joinName:
+			c.join(group)
+		default:
+			delete(c.groups, group)
+		}
+		s.Unlock()
+	}
+
+	if msg.Meta&MsgReq != MsgReq {
+		return
+	}
+	if err != nil {
+		out.write(errFrame(msg, err))
+		return
+	}
+	var id [12]byte
+	copy(id[:], msg.ID)
+	out.writeFrame(id, 0, msg.Name, nil, nil)
+}
+
+// Add client to group.
+// Should be called under lock.
+func (c *ConnectedClient) join(group string) {
+	if c.groups == nil {
+		c.groups = make(map[string]bool)
+	}
+	c.groups[group] = true
+}
+
+// Join asks server to add client to group and waits for
+// confirmation. Groups are joined again after reconnection.
+func (c *Client) Join(ctx context.Context, group string) error {
+	_, err := c.request(ctx, Msg{Name: joinName, Body: []byte(group)})
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	if c.groups == nil {
+		c.groups = make(map[string]bool)
+	}
+	c.groups[group] = true
+	c.Unlock()
+	return nil
+}
+
+// Leave asks server to remove client from group.
+func (c *Client) Leave(ctx context.Context, group string) error {
+	c.Lock()
+	delete(c.groups, group)
+	c.Unlock()
+
+	_, err := c.request(ctx, Msg{Name: leaveName, Body: []byte(group)})
+	return err
+}
+
+// Join groups after reconnection.
+// Should be called under lock.
+func (c *Client) rejoin() error {
+	for group := range c.groups {
+		err := c.writeFrame(BID12(), MsgWithBody, joinName, nil, []byte(group))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
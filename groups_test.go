@@ -0,0 +1,99 @@
+package con
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGroups(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{
+		AuthorizeJoin: func(c ConnectedClient, group string) error {
+			if group == "private" {
+				return errors.New("forbidden")
+			}
+			return nil
+		},
+	}
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	received := make(chan string, 10)
+	connect := func(name string) *Client {
+		client := &Client{}
+		client.On("news", func(msg Msg) []byte {
+			received <- name + ":" + string(msg.Body)
+			return nil
+		})
+		if err := client.Connect(addr, name); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	a := connect("a")
+	defer a.Disconnect()
+	b := connect("b")
+	c := connect("c")
+	defer c.Disconnect()
+
+	ctx := context.Background()
+	if err := a.Join(ctx, "eu"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Join(ctx, "eu"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Join(ctx, "private"); err == nil {
+		t.Error("Join should be rejected")
+	}
+	if err := server.Join("c", "us"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Join("nobody", "us"); err != ErrNoClient {
+		t.Errorf("Wrong error: %v", err)
+	}
+
+	expect := func(want ...string) {
+		t.Helper()
+		got := map[string]bool{}
+		for range want {
+			select {
+			case m := <-received:
+				got[m] = true
+			case <-time.After(time.Second):
+				t.Fatalf("Missing messages, got %v", got)
+			}
+		}
+		for _, w := range want {
+			if !got[w] {
+				t.Errorf("Message %q is not received, got %v", w, got)
+			}
+		}
+		select {
+		case m := <-received:
+			t.Errorf("Unexpected message %q", m)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	server.BroadcastTo("eu", "news", []byte("1"))
+	expect("a:1", "b:1")
+	server.BroadcastTo("us", "news", []byte("2"))
+	expect("c:2")
+	server.BroadcastExcept(a.ID, "eu", "news", []byte("3"))
+	expect("b:3")
+	server.BroadcastExcept(a.ID, "", "news", []byte("4"))
+	expect("b:4", "c:4")
+
+	// Leave and disconnect
+	if err := a.Leave(ctx, "eu"); err != nil {
+		t.Fatal(err)
+	}
+	b.Disconnect()
+	time.Sleep(50 * time.Millisecond)
+	server.BroadcastTo("eu", "news", []byte("5"))
+	expect()
+}
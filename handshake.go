@@ -0,0 +1,127 @@
+package con
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions. Version 0 is legacy handshake with client
+// name only, without any features.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 0
+)
+
+// Protocol features
+const (
+	FeatureHeaders   = "headers"
+	FeatureHeartbeat = "heartbeat"
+)
+
+// Features supported by this implementation.
+var Features = []string{FeatureHeaders, FeatureHeartbeat}
+
+// Handshake request/answer. Client sends hello message with max
+// version, min version, features and credentials, then handshake
+// request with its name only, so legacy servers which take the
+// whole body as name ignore hello. Answer carries client id,
+// version and features. Fields are separated by zero byte.
+type handshakeInfo struct {
+	value       string
+	version     int
+	minVersion  int
+	features    []string
+	credentials []byte
+}
+
+// Encode hello (req) or answer.
+func encodeHandshake(h handshakeInfo, req bool) []byte {
+	var fields []string
+	if !req {
+		fields = append(fields, h.value)
+	}
+	fields = append(fields, strconv.Itoa(h.version))
+	if req {
+		fields = append(fields, strconv.Itoa(h.minVersion))
+	}
+	fields = append(fields, strings.Join(h.features, ","))
+	if req {
+		fields = append(fields, string(h.credentials))
+	}
+	return []byte(strings.Join(fields, "\x00"))
+}
+
+// Decode hello (req) or answer.
+func decodeHandshake(body []byte, req bool) (handshakeInfo, error) {
+	var h handshakeInfo
+	if !req {
+		// Legacy server answers with id only
+		i := bytes.IndexByte(body, 0)
+		if i == -1 {
+			return handshakeInfo{value: string(body)}, nil
+		}
+		h.value = string(body[:i])
+		body = body[i+1:]
+	}
+
+	// Credentials are the last field and can contain zero bytes
+	count := 2
+	if req {
+		count = 4
+	}
+	fields := strings.SplitN(string(body), "\x00", count)
+	if len(fields) != count {
+		return handshakeInfo{}, ErrBadHandshake
+	}
+
+	var err error
+	h.version, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return handshakeInfo{}, ErrBadHandshake
+	}
+	h.minVersion = h.version
+	features := fields[1]
+	if req {
+		h.minVersion, err = strconv.Atoi(fields[1])
+		if err != nil {
+			return handshakeInfo{}, ErrBadHandshake
+		}
+		features = fields[2]
+		if fields[3] != "" {
+			h.credentials = []byte(fields[3])
+		}
+	}
+	if features != "" {
+		h.features = strings.Split(features, ",")
+	}
+	return h, nil
+}
+
+// Pick the highest common version and common features.
+func negotiate(peer handshakeInfo, minVersion int, features []string) (int, []string, error) {
+	version := ProtocolVersion
+	if peer.version < version {
+		version = peer.version
+	}
+	if version < minVersion || version < peer.minVersion || version < MinProtocolVersion {
+		return 0, nil, ErrIncompatible
+	}
+
+	var common []string
+	for _, f := range peer.features {
+		if hasFeature(features, f) {
+			common = append(common, f)
+		}
+	}
+	return version, common, nil
+}
+
+func hasFeature(features []string, f string) bool {
+	for i := range features {
+		if features[i] == f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package con
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeEncoding(t *testing.T) {
+	hello := handshakeInfo{version: 3, minVersion: 1, features: []string{"a", "b"}, credentials: []byte("x\x00y")}
+	out, err := decodeHandshake(encodeHandshake(hello, true), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.version != 3 || out.minVersion != 1 || len(out.features) != 2 || string(out.credentials) != "x\x00y" {
+		t.Errorf("Unexpected hello: %+v", out)
+	}
+
+	ans := handshakeInfo{value: "id", version: 2, features: []string{"a"}}
+	out, err = decodeHandshake(encodeHandshake(ans, false), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.value != "id" || out.version != 2 || len(out.features) != 1 {
+		t.Errorf("Unexpected answer: %+v", out)
+	}
+
+	// Legacy
+	out, err = decodeHandshake([]byte("id"), false)
+	if err != nil || out.value != "id" || out.version != 0 || out.features != nil {
+		t.Errorf("Unexpected legacy answer: %+v", out)
+	}
+
+	// Malformed
+	if _, err = decodeHandshake([]byte("x\x000\x00"), true); err != ErrBadHandshake {
+		t.Errorf("Malformed hello should not be decoded: %v", err)
+	}
+	if _, err = decodeHandshake([]byte("id\x00x\x00"), false); err != ErrBadHandshake {
+		t.Errorf("Malformed answer should not be decoded: %v", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	version, features, err := negotiate(handshakeInfo{
+		version:  ProtocolVersion + 1,
+		features: []string{FeatureHeaders, "unknown"},
+	}, 0, Features)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != ProtocolVersion {
+		t.Errorf("Wrong version: %d", version)
+	}
+	if len(features) != 1 || features[0] != FeatureHeaders {
+		t.Errorf("Wrong features: %v", features)
+	}
+
+	// Legacy peer
+	if _, _, err = negotiate(handshakeInfo{}, 1, Features); err != ErrIncompatible {
+		t.Errorf("Legacy peer should be rejected: %v", err)
+	}
+
+	// Peer requires newer version
+	if _, _, err = negotiate(handshakeInfo{version: 9, minVersion: 9}, 0, Features); err != ErrIncompatible {
+		t.Errorf("Newer peer should be rejected: %v", err)
+	}
+}
+
+// Server which takes whole handshake body as client name and
+// answers with id only.
+func legacyServer(t *testing.T, names chan<- string, msgs chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		stream, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		d := NewDecoder(stream)
+		defer d.Release()
+		for {
+			msg, err := d.Decode()
+			if err != nil {
+				return
+			}
+			if msg.Name != "handshake" {
+				msgs <- msg.Name
+				continue
+			}
+			names <- string(msg.Body)
+			var id [12]byte
+			copy(id[:], msg.ID)
+			writeMsg(stream, id, MsgWithBody, msg.Name, []byte("legacy-id"))
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestLegacyServer(t *testing.T) {
+	names := make(chan string, 1)
+	msgs := make(chan string, 10)
+	addr := legacyServer(t, names, msgs)
+
+	client := Client{Credentials: []byte("secret")}
+	if err := client.Connect(addr, "worker"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if name := <-names; name != "worker" {
+		t.Errorf("Legacy server got wrong name: %q", name)
+	}
+	if client.ID != "legacy-id" || client.Version != 0 || client.Features != nil {
+		t.Errorf("Unexpected negotiation: %q, %d, %v", client.ID, client.Version, client.Features)
+	}
+
+	// Headers are not sent to legacy server
+	client.SendMsg(Msg{Name: "event", Headers: Headers{"k": "v"}})
+	for {
+		select {
+		case name := <-msgs:
+			if name == "event" {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Message is not received")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package con
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Headers - message metadata, e.g. trace id or content type.
+// Keys are limited by 255 bytes, values by 65535 bytes, longer
+// ones fail sending with ErrHeaderTooLong.
+type Headers map[string]string
+
+var errBadHeaders = errors.New("malformed headers")
+
+// Check that headers fit into headers section.
+func checkHeaders(h Headers) error {
+	for k, v := range h {
+		if len(k) > 255 || len(v) > 65535 {
+			return ErrHeaderTooLong
+		}
+	}
+	return nil
+}
+
+// Encode headers section: for each pair 1-byte key len, key,
+// 2-bytes value len, value. Returns nil for empty headers.
+func encodeHeaders(h Headers) ([]byte, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+	if err := checkHeaders(h); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(h))
+	size := 0
+	for k, v := range h {
+		keys = append(keys, k)
+		size += 3 + len(k) + len(v)
+	}
+	sort.Strings(keys)
+
+	out := make([]byte, 0, size)
+	for _, k := range keys {
+		v := h[k]
+		out = append(out, byte(len(k)))
+		out = append(out, k...)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(v)))
+		out = append(out, v...)
+	}
+	return out, nil
+}
+
+// Decode headers section.
+func decodeHeaders(data []byte) (Headers, error) {
+	h := make(Headers)
+	for len(data) > 0 {
+		keyEnd := 1 + int(data[0])
+		if len(data) < keyEnd+2 {
+			return nil, errBadHeaders
+		}
+		valEnd := keyEnd + 2 + int(binary.BigEndian.Uint16(data[keyEnd:keyEnd+2]))
+		if len(data) < valEnd {
+			return nil, errBadHeaders
+		}
+		h[string(data[1:keyEnd])] = string(data[keyEnd+2 : valEnd])
+		data = data[valEnd:]
+	}
+	return h, nil
+}
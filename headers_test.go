@@ -0,0 +1,75 @@
+package con
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	h := Headers{"trace-id": "abc", HeaderContentType: "application/json", "empty": ""}
+	data, err := encodeHeaders(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := decodeHeaders(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(h) {
+		t.Errorf("Wrong headers count: %d", len(out))
+	}
+	for k, v := range h {
+		if out[k] != v {
+			t.Errorf("Wrong header %q: %q", k, out[k])
+		}
+	}
+
+	if data, _ := encodeHeaders(nil); data != nil {
+		t.Error("Empty headers should be encoded to nil")
+	}
+
+	// Too long keys and values are not dropped silently
+	for _, h := range []Headers{
+		{strings.Repeat("k", 256): "v"},
+		{"k": strings.Repeat("v", 65536)},
+	} {
+		if _, err := encodeFrame(BID12(), 0, "name", h, nil); err != ErrHeaderTooLong {
+			t.Errorf("Wrong error: %v", err)
+		}
+	}
+
+	// Truncated
+	if _, err := decodeHeaders([]byte{3, 'a', 'b', 'c', 0}); err == nil {
+		t.Error("Truncated headers should not be decoded")
+	}
+}
+
+func TestReadStreamHeaders(t *testing.T) {
+	var stream bytes.Buffer
+	h := Headers{"reply-to": "somebody"}
+	writeFrame(&stream, BID12(), MsgWithBody, "first", h, []byte("body"))
+	writeFrame(&stream, BID12(), 0, "second", h, nil)
+	writeMsg(&stream, BID12(), MsgWithBody, "third", []byte("plain"))
+
+	var msgs []Msg
+	d := NewDecoder(&stream)
+	defer d.Release()
+	readStream("test", d, func(msg Msg) bool {
+		msgs = append(msgs, msg)
+		return true
+	})
+
+	if len(msgs) != 3 {
+		t.Fatalf("Wrong messages count: %d", len(msgs))
+	}
+	if msgs[0].Name != "first" || string(msgs[0].Body) != "body" || msgs[0].Headers["reply-to"] != "somebody" {
+		t.Errorf("Unexpected first message: %+v", msgs[0])
+	}
+	if msgs[1].Name != "second" || msgs[1].Body != nil || msgs[1].Headers["reply-to"] != "somebody" {
+		t.Errorf("Unexpected second message: %+v", msgs[1])
+	}
+	if msgs[2].Name != "third" || string(msgs[2].Body) != "plain" || msgs[2].Headers != nil {
+		t.Errorf("Unexpected third message: %+v", msgs[2])
+	}
+}
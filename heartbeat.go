@@ -0,0 +1,79 @@
+package con
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// HeartbeatOptions - ping/pong heartbeats. Pings are sent only
+// if peer supports them (FeatureHeartbeat), peer answers with
+// pongs. Connection is closed when nothing is received during
+// timeout.
+type HeartbeatOptions struct {
+	// Interval - period of pings.
+	Interval time.Duration
+
+	// Timeout - max time without any received frame. 0 - three
+	// intervals.
+	Timeout time.Duration
+}
+
+func (h *HeartbeatOptions) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return 3 * h.Interval
+}
+
+// Reader of connection which sets read deadline before each
+// read. Timeout can be changed during reading.
+type deadlineReader struct {
+	conn interface {
+		io.Reader
+		SetReadDeadline(t time.Time) error
+	}
+	timeout int64 // atomic, nanoseconds, 0 - no deadline
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	var deadline time.Time
+	if t := atomic.LoadInt64(&r.timeout); t > 0 {
+		deadline = time.Now().Add(time.Duration(t))
+	}
+	r.conn.SetReadDeadline(deadline)
+	return r.conn.Read(p)
+}
+
+// Set read timeout: the smaller of idle timeout and timeout of
+// heartbeats if they are enabled.
+func (r *deadlineReader) setTimeout(idle time.Duration, heartbeat *HeartbeatOptions) {
+	timeout := idle
+	if heartbeat != nil && heartbeat.Interval > 0 {
+		if t := heartbeat.timeout(); timeout == 0 || t < timeout {
+			timeout = t
+		}
+	}
+	atomic.StoreInt64(&r.timeout, int64(timeout))
+
+	// Apply to pending read
+	if timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// Send pings until ping fails or done is closed.
+func sendPings(interval time.Duration, done <-chan struct{}, ping func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if ping() != nil {
+				return
+			}
+		}
+	}
+}
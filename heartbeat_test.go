@@ -0,0 +1,183 @@
+package con
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeadlineReader(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	r := &deadlineReader{conn: local}
+
+	// Timeout is applied to pending read
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.setTimeout(time.Second, &HeartbeatOptions{Interval: 5 * time.Millisecond})
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("Expected timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pending read is not timed out")
+	}
+
+	// Each read prolongs deadline
+	r.setTimeout(50*time.Millisecond, nil)
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			remote.Write([]byte{byte(i)})
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := r.Read(buf); err != nil {
+			t.Fatalf("Unexpected error of read %d: %v", i, err)
+		}
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	h := HeartbeatOptions{Interval: time.Second}
+	if h.timeout() != 3*time.Second {
+		t.Errorf("Unexpected default timeout: %v", h.timeout())
+	}
+	h.Timeout = time.Minute
+	if h.timeout() != time.Minute {
+		t.Errorf("Unexpected timeout: %v", h.timeout())
+	}
+}
+
+func TestServerHeartbeat(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{Heartbeat: &HeartbeatOptions{Interval: 20 * time.Millisecond}}
+	reasons := make(chan error, 2)
+	server.OnDisconnect(func(c ConnectedClient, reason error) {
+		reasons <- reason
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Client answers pings
+	client := Client{}
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Peer which negotiates heartbeats and does not answer
+	stream, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	writeMsg(stream, BID12(), MsgWithBody, helloName, encodeHandshake(handshakeInfo{version: ProtocolVersion, features: Features}, true))
+	writeMsg(stream, BID12(), MsgWithBody|MsgReq, "handshake", []byte("silent"))
+	pinged := make(chan struct{})
+	go func() {
+		d := NewDecoder(stream)
+		defer d.Release()
+		for {
+			msg, err := d.Decode()
+			if err != nil {
+				return
+			}
+			if msg.Name == pingName {
+				close(pinged)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-pinged:
+	case <-time.After(time.Second):
+		t.Fatal("Peer is not pinged")
+	}
+	select {
+	case reason := <-reasons:
+		if reason != ErrHeartbeatTimeout {
+			t.Errorf("Wrong reason: %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Silent peer is not disconnected")
+	}
+
+	// Client which answers is kept
+	time.Sleep(100 * time.Millisecond)
+	if state := client.State(); state != StateConnected {
+		t.Errorf("Wrong state: %s", state)
+	}
+	select {
+	case reason := <-reasons:
+		t.Errorf("Client is disconnected: %v", reason)
+	default:
+	}
+}
+
+func TestClientHeartbeat(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Server which negotiates heartbeats and goes silent
+	go func() {
+		stream, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		d := NewDecoder(stream)
+		defer d.Release()
+		for {
+			msg, err := d.Decode()
+			if err != nil {
+				return
+			}
+			if msg.Name == "handshake" {
+				var id [12]byte
+				copy(id[:], msg.ID)
+				writeMsg(stream, id, MsgWithBody, msg.Name, encodeHandshake(handshakeInfo{
+					value:    "id",
+					version:  ProtocolVersion,
+					features: Features,
+				}, false))
+			}
+		}
+	}()
+
+	client := Client{Heartbeat: &HeartbeatOptions{Interval: 20 * time.Millisecond}}
+	states := make(chan ClientState, 4)
+	client.OnState(func(state ClientState) {
+		states <- state
+	})
+	disconnected := make(chan struct{}, 1)
+	client.On(EventDisconnect, func(msg Msg) (ans []byte) {
+		disconnected <- struct{}{}
+		return
+	})
+	if err := client.Connect(l.Addr().String(), "client"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Silent server is not disconnected")
+	}
+	for _, expected := range []ClientState{StateConnecting, StateConnected, StateClosed} {
+		if state := <-states; state != expected {
+			t.Errorf("Wrong state: %s, expected %s", state, expected)
+		}
+	}
+}
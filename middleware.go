@@ -0,0 +1,30 @@
+package con
+
+// Middleware wraps execution of handlers, e.g. for logging, auth
+// checks or metrics. It can stop handling by returning error
+// without calling next, the error is sent back if message is
+// request.
+type Middleware func(next ErrHandler) ErrHandler
+
+// Interceptor is called before outbound message is written:
+// sends, broadcasts, requests and answers. It can modify message,
+// returned error cancels sending.
+type Interceptor func(msg *Msg) error
+
+// Wrap handler by middlewares, the first one is the outermost.
+func chain(h ErrHandler, middlewares []Middleware) ErrHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Pass outbound message through interceptors.
+func intercept(msg *Msg, interceptors []Interceptor) error {
+	for _, i := range interceptors {
+		if err := i(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package con
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) Middleware {
+		return func(next ErrHandler) ErrHandler {
+			return func(msg Msg) ([]byte, error) {
+				calls = append(calls, name)
+				ans, err := next(msg)
+				calls = append(calls, name)
+				return ans, err
+			}
+		}
+	}
+	handler := func(msg Msg) ([]byte, error) {
+		calls = append(calls, "handler")
+		return msg.Body, nil
+	}
+
+	ans, err := chain(handler, []Middleware{mw("a"), mw("b")})(Msg{Body: []byte("x")})
+	if err != nil || string(ans) != "x" {
+		t.Fatalf("Wrong answer: %q, %v", ans, err)
+	}
+	if strings.Join(calls, ",") != "a,b,handler,b,a" {
+		t.Errorf("Wrong order of calls: %v", calls)
+	}
+
+	// Short circuit
+	calls = nil
+	deny := errors.New("denied")
+	stop := func(next ErrHandler) ErrHandler {
+		return func(msg Msg) ([]byte, error) {
+			return nil, deny
+		}
+	}
+	_, err = chain(handler, []Middleware{mw("a"), stop, mw("b")})(Msg{})
+	if err != deny {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if strings.Join(calls, ",") != "a,a" {
+		t.Errorf("Wrong calls: %v", calls)
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	upper := func(msg *Msg) error {
+		msg.Body = []byte(strings.ToUpper(string(msg.Body)))
+		return nil
+	}
+	deny := errors.New("denied")
+	var called bool
+	interceptors := []Interceptor{
+		upper,
+		func(msg *Msg) error {
+			if msg.Name == "secret" {
+				return deny
+			}
+			return nil
+		},
+		func(msg *Msg) error {
+			called = true
+			return nil
+		},
+	}
+
+	msg := Msg{Name: "a", Body: []byte("abc")}
+	if err := intercept(&msg, interceptors); err != nil || string(msg.Body) != "ABC" || !called {
+		t.Errorf("Wrong result: %q, %v", msg.Body, err)
+	}
+
+	called = false
+	msg = Msg{Name: "secret"}
+	if err := intercept(&msg, interceptors); err != deny || called {
+		t.Errorf("Message is not canceled: %v", err)
+	}
+}
+
+func TestMiddlewareConnection(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{}
+	var serverCalls int32
+	server.Use(func(next ErrHandler) ErrHandler {
+		return func(msg Msg) ([]byte, error) {
+			atomic.AddInt32(&serverCalls, 1)
+			if msg.Name == "forbidden" {
+				return nil, errors.New("denied")
+			}
+			ans, err := next(msg)
+			return append([]byte("mw:"), ans...), err
+		}
+	})
+	server.Intercept(func(msg *Msg) error {
+		msg.Headers = Headers{"via": "server"}
+		return nil
+	})
+	server.On("", "echo", func(msg Msg) (ans []byte) {
+		return []byte(msg.Headers["via"])
+	})
+	server.On("", "forbidden", func(msg Msg) (ans []byte) {
+		t.Error("Handler is called after short circuit")
+		return
+	})
+	server.Once("", "once", func(msg Msg) (ans []byte) {
+		return []byte("once")
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{}
+	names := make(chan string, 10)
+	client.Use(func(next ErrHandler) ErrHandler {
+		return func(msg Msg) ([]byte, error) {
+			names <- msg.Name
+			return next(msg)
+		}
+	})
+	client.Intercept(func(msg *Msg) error {
+		msg.Headers = Headers{"via": "client"}
+		return nil
+	})
+	news := make(chan Msg, 1)
+	client.On("news", func(msg Msg) (ans []byte) {
+		news <- msg
+		return
+	})
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Middleware wraps handler, interceptors change request and answer
+	ans, err := client.Request(ctx, "echo", nil)
+	if err != nil || string(ans.Body) != "mw:client" || ans.Headers["via"] != "server" {
+		t.Errorf("Unexpected answer: %q, %v, %v", ans.Body, ans.Headers, err)
+	}
+
+	// Short circuit error reaches requester
+	_, err = client.Request(ctx, "forbidden", nil)
+	var re *RemoteError
+	if !errors.As(err, &re) || re.Message != "denied" {
+		t.Errorf("Wrong error: %v", err)
+	}
+
+	// Once rule is wrapped and called once
+	atomic.StoreInt32(&serverCalls, 0)
+	ans, err = client.Request(ctx, "once", nil)
+	if err != nil || string(ans.Body) != "mw:once" {
+		t.Errorf("Unexpected answer: %q, %v", ans.Body, err)
+	}
+	_, err = client.Request(ctx, "once", nil)
+	if !errors.As(err, &re) || re.Code != CodeNoHandler {
+		t.Errorf("Once rule is called again: %v", err)
+	}
+	if n := atomic.LoadInt32(&serverCalls); n != 1 {
+		t.Errorf("Wrong number of middleware calls: %d", n)
+	}
+
+	// Broadcast is intercepted, client middleware wraps its handler
+	if err := server.Broadcast("news", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-news:
+		if string(msg.Body) != "hi" || msg.Headers["via"] != "server" {
+			t.Errorf("Unexpected message: %q, %v", msg.Body, msg.Headers)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Broadcast is not received")
+	}
+	if name := <-names; name != "news" {
+		t.Errorf("Client middleware got %q", name)
+	}
+}
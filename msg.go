@@ -2,15 +2,49 @@ package con
 
 // Message meta
 const (
-	MsgWithBody = byte(1 << 7)
-	MsgReq      = byte(1 << 6)
+	MsgWithBody    = byte(1 << 7)
+	MsgReq         = byte(1 << 6)
+	MsgErr         = byte(1 << 5)
+	MsgWithHeaders = byte(1 << 4)
+)
+
+// Well-known headers
+const (
+	HeaderContentType = "content-type"
 )
 
 // Msg type
 type Msg struct {
-	ID     []byte
-	Author string
-	Meta   byte
-	Name   string
-	Body   []byte
+	ID      []byte
+	Author  string
+	Meta    byte
+	Name    string
+	Headers Headers
+	Body    []byte
+}
+
+// Copy id and body, e.g. to keep borrowed message.
+func (m Msg) copy() Msg {
+	m.ID = append([]byte(nil), m.ID...)
+	if m.Body != nil {
+		m.Body = append([]byte(nil), m.Body...)
+	}
+	return m
+}
+
+// Err returns *RemoteError if message is an error response.
+func (m Msg) Err() error {
+	if m.Meta&MsgErr != MsgErr {
+		return nil
+	}
+	return decodeRemoteError(m.Body)
+}
+
+// Codec returns registered codec announced in content-type
+// header or def if there is no such.
+func (m Msg) Codec(def Codec) Codec {
+	if c, ok := CodecFor(m.Headers[HeaderContentType]); ok {
+		return c
+	}
+	return def
 }
@@ -0,0 +1,9 @@
+package con
+
+// PeerCred - credentials of process on the other side of
+// unix socket.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package con
+
+import (
+	"net"
+	"syscall"
+)
+
+// Read peer credentials of unix socket connection (SO_PEERCRED).
+func peerCred(conn net.Conn) *PeerCred {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return nil
+	}
+
+	return &PeerCred{
+		PID: cred.Pid,
+		UID: cred.Uid,
+		GID: cred.Gid,
+	}
+}
@@ -0,0 +1,40 @@
+package con
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerCred(t *testing.T) {
+	addr := filepath.Join(os.TempDir(), fmt.Sprintf("con-test-%d.sock", os.Getpid()))
+	server := Server{}
+	server.OnUID(uint32(os.Getuid()), "whoami", func(msg Msg) (ans []byte) {
+		return []byte("me")
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{}
+	err := client.Connect(addr, "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	ans, err := client.Request(context.Background(), "whoami", nil)
+	if err != nil || string(ans.Body) != "me" {
+		t.Fatalf("Unexpected answer: %q, %v", ans.Body, err)
+	}
+
+	server.Lock()
+	cred := server.Clients[0].Cred
+	server.Unlock()
+	if cred == nil || cred.PID != int32(os.Getpid()) || cred.UID != uint32(os.Getuid()) || cred.GID != uint32(os.Getgid()) {
+		t.Errorf("Unexpected peer credentials: %+v", cred)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package con
+
+import "net"
+
+// Peer credentials are supported only on linux.
+func peerCred(conn net.Conn) *PeerCred {
+	return nil
+}
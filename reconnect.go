@@ -0,0 +1,82 @@
+package con
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ClientState - state of client connection.
+type ClientState int
+
+// Client states
+const (
+	StateClosed ClientState = iota
+	StateConnecting
+	StateConnected
+	StateReconnecting
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return "closed"
+	}
+}
+
+// ReconnectPolicy defines what to do with messages
+// sent while client is reconnecting.
+type ReconnectPolicy int
+
+// Reconnect policies
+const (
+	// Queue messages and send them after reconnection.
+	Queue ReconnectPolicy = iota
+	// Return ErrReconnecting immediately.
+	FailFast
+)
+
+// ReconnectOptions - backoff settings for Client.Reconnect.
+// Delay before n-th attempt is MinDelay * Factor^n limited by
+// MaxDelay, randomized by +-Jitter fraction.
+type ReconnectOptions struct {
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+	Factor      float64
+	Jitter      float64
+	MaxAttempts int // 0 - unlimited
+	Policy      ReconnectPolicy
+	QueueSize   int // 0 - unlimited
+}
+
+// Get delay before attempt.
+func (o *ReconnectOptions) delay(attempt int) time.Duration {
+	minDelay := o.MinDelay
+	if minDelay <= 0 {
+		minDelay = 100 * time.Millisecond
+	}
+	maxDelay := o.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	factor := o.Factor
+	if factor < 1 {
+		factor = 2
+	}
+
+	d := float64(minDelay) * math.Pow(factor, float64(attempt))
+	if d > float64(maxDelay) {
+		d = float64(maxDelay)
+	}
+	if o.Jitter > 0 {
+		d += d * o.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(d)
+}
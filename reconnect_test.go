@@ -0,0 +1,250 @@
+package con
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	opts := ReconnectOptions{
+		MinDelay: 10 * time.Millisecond,
+		MaxDelay: 50 * time.Millisecond,
+		Factor:   2,
+	}
+
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i := range expected {
+		d := opts.delay(i)
+		if d != expected[i]*time.Millisecond {
+			t.Errorf("Wrong delay for attempt %d: %s", i, d)
+		}
+	}
+
+	// Jitter
+	opts.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := opts.delay(0)
+		if d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Errorf("Delay out of jitter range: %s", d)
+		}
+	}
+}
+
+func TestReconnectGiveUp(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{}
+	go server.Listen(addr)
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{Reconnect: &ReconnectOptions{MinDelay: 10 * time.Millisecond, MaxAttempts: 2}}
+	states := make(chan ClientState, 10)
+	client.OnState(func(state ClientState) {
+		states <- state
+	})
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	<-states // connecting
+	<-states // connected
+
+	server.Close()
+	if state := <-states; state != StateReconnecting {
+		t.Fatalf("Wrong state: %s", state)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Request(context.Background(), "ping", nil)
+		done <- err
+	}()
+	if state := <-states; state != StateClosed {
+		t.Fatalf("Wrong state: %s", state)
+	}
+	select {
+	case err := <-done:
+		if err != ErrDisconnected {
+			t.Errorf("Wrong error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Queued request is not failed")
+	}
+}
+
+func TestReconnectFailedAttempt(t *testing.T) {
+	addr := testTCPAddr(t)
+	var attempts int32
+	server := Server{
+		Authenticate: func(name string, credentials []byte, peer PeerInfo) (Identity, error) {
+			// The first reconnection attempt fails
+			if atomic.AddInt32(&attempts, 1) == 2 {
+				return Identity{}, errors.New("not yet")
+			}
+			return Identity{}, nil
+		},
+	}
+	server.On("", "ping", func(msg Msg) (ans []byte) {
+		return []byte("pong")
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{Reconnect: &ReconnectOptions{MinDelay: 100 * time.Millisecond}}
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Request queued while reconnecting survives failed attempt
+	server.Disconnect("client")
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ans, err := client.Request(ctx, "ping", nil)
+	if err != nil || string(ans.Body) != "pong" {
+		t.Errorf("Unexpected answer: %q, %v", ans.Body, err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("Wrong number of handshakes: %d", n)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	for _, policy := range []ReconnectPolicy{Queue, FailFast} {
+		addr := testTCPAddr(t)
+		server := &Server{}
+		go server.Listen(addr)
+		time.Sleep(50 * time.Millisecond)
+
+		client := Client{Reconnect: &ReconnectOptions{MinDelay: 50 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Policy: policy}}
+		states := make(chan ClientState, 10)
+		client.OnState(func(state ClientState) {
+			states <- state
+		})
+		news := make(chan string, 1)
+		client.On("news", func(msg Msg) (ans []byte) {
+			news <- string(msg.Body)
+			return
+		})
+		if err := client.Connect(addr, "client"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Restart server
+		server.Close()
+		for _, expected := range []ClientState{StateConnecting, StateConnected, StateReconnecting} {
+			if state := <-states; state != expected {
+				t.Fatalf("Wrong state: %s, expected %s", state, expected)
+			}
+		}
+		done := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			ans, err := client.Request(ctx, "ping", nil)
+			if err == nil && string(ans.Body) != "pong" {
+				t.Errorf("Unexpected answer: %q", ans.Body)
+			}
+			done <- err
+		}()
+		if policy == FailFast {
+			if err := <-done; err != ErrReconnecting {
+				t.Errorf("Wrong error: %v", err)
+			}
+		}
+		server = &Server{}
+		server.On("client", "ping", func(msg Msg) (ans []byte) {
+			return []byte("pong")
+		})
+		go server.Listen(addr)
+
+		if state := <-states; state != StateConnected {
+			t.Fatalf("Wrong state: %s", state)
+		}
+		if policy == Queue {
+			if err := <-done; err != nil {
+				t.Errorf("Queued request failed: %v", err)
+			}
+		}
+
+		// Handshake is redone under the same name and rules are kept
+		if err := server.Send("client", "news", []byte("restarted")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case body := <-news:
+			if body != "restarted" {
+				t.Errorf("Unexpected message: %q", body)
+			}
+		case <-time.After(time.Second):
+			t.Error("Rule is lost on reconnection")
+		}
+
+		client.Disconnect()
+		server.Close()
+		if state := <-states; state != StateClosed {
+			t.Errorf("Wrong state: %s", state)
+		}
+	}
+}
+
+func TestReconnectLostInHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The first connection is kept until dropped by test, the next
+	// ones are closed right after handshake
+	const drops = 10
+	streams := make(chan net.Conn, drops+2)
+	go func() {
+		for n := 0; ; n++ {
+			stream, err := l.Accept()
+			if err != nil {
+				return
+			}
+			d := NewDecoder(stream)
+			for {
+				msg, err := d.Decode()
+				if err != nil {
+					break
+				}
+				if msg.Name == "handshake" {
+					var id [12]byte
+					copy(id[:], msg.ID)
+					writeMsg(stream, id, MsgWithBody, msg.Name, []byte("id"))
+					break
+				}
+			}
+			d.Release()
+			if n > 0 && n <= drops {
+				stream.Close()
+				continue
+			}
+			streams <- stream
+		}
+	}()
+
+	client := Client{Reconnect: &ReconnectOptions{MinDelay: time.Millisecond, MaxDelay: time.Millisecond}}
+	if err := client.Connect(l.Addr().String(), "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	(<-streams).Close()
+
+	select {
+	case stream := <-streams:
+		defer stream.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Client is stuck in state %s", client.State())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if state := client.State(); state != StateConnected {
+		t.Errorf("Wrong state: %s", state)
+	}
+}
@@ -0,0 +1,178 @@
+package con
+
+import "strings"
+
+// Message and client names are matched by patterns of tokens
+// separated by dots: "*" matches exactly one token, ">" matches
+// one or more tokens at the end, e.g. "orders.*.failed" or
+// "orders.>". Empty pattern matches any name.
+
+// Rules with index by message name pattern. Should be used
+// under lock of owner.
+type ruleTable struct {
+	rules   map[uint64]*Rule
+	any     []*Rule
+	names   ruleNode
+	regexps []*Rule
+}
+
+// Node of tokens trie.
+type ruleNode struct {
+	children map[string]*ruleNode
+	wildcard *ruleNode
+	rules    []*Rule // pattern ends here
+	tail     []*Rule // pattern ends with ">" here
+}
+
+func (t *ruleTable) add(r *Rule) {
+	if t.rules == nil {
+		t.rules = make(map[uint64]*Rule)
+	}
+	t.rules[r.id] = r
+	switch {
+	case r.msgRegexp != nil:
+		t.regexps = append(t.regexps, r)
+	case r.msgName == "":
+		t.any = append(t.any, r)
+	default:
+		t.names.insert(strings.Split(r.msgName, "."), r)
+	}
+}
+
+// Remove matched rules.
+func (t *ruleTable) remove(match func(r *Rule) bool) {
+	for _, r := range t.rules {
+		if match(r) {
+			t.removeRule(r)
+		}
+	}
+}
+
+func (t *ruleTable) removeRule(r *Rule) {
+	if t.rules[r.id] != r {
+		return
+	}
+	delete(t.rules, r.id)
+	switch {
+	case r.msgRegexp != nil:
+		t.regexps = withoutRule(t.regexps, r)
+	case r.msgName == "":
+		t.any = withoutRule(t.any, r)
+	default:
+		t.names.remove(strings.Split(r.msgName, "."), r)
+	}
+}
+
+// Find rules which name pattern matches message name.
+func (t *ruleTable) lookup(name string) []*Rule {
+	out := append([]*Rule(nil), t.any...)
+	out = t.names.match(strings.Split(name, "."), out)
+	for _, r := range t.regexps {
+		if r.msgRegexp.MatchString(name) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (n *ruleNode) insert(tokens []string, r *Rule) {
+	if len(tokens) == 0 {
+		n.rules = append(n.rules, r)
+		return
+	}
+
+	token := tokens[0]
+	if token == ">" && len(tokens) == 1 {
+		n.tail = append(n.tail, r)
+		return
+	}
+
+	var next *ruleNode
+	if token == "*" {
+		if n.wildcard == nil {
+			n.wildcard = &ruleNode{}
+		}
+		next = n.wildcard
+	} else {
+		if n.children == nil {
+			n.children = make(map[string]*ruleNode)
+		}
+		next = n.children[token]
+		if next == nil {
+			next = &ruleNode{}
+			n.children[token] = next
+		}
+	}
+	next.insert(tokens[1:], r)
+}
+
+// Remove rule and prune empty nodes.
+func (n *ruleNode) remove(tokens []string, r *Rule) {
+	if len(tokens) == 0 {
+		n.rules = withoutRule(n.rules, r)
+		return
+	}
+
+	token := tokens[0]
+	if token == ">" && len(tokens) == 1 {
+		n.tail = withoutRule(n.tail, r)
+		return
+	}
+
+	if token == "*" {
+		if n.wildcard != nil {
+			n.wildcard.remove(tokens[1:], r)
+			if n.wildcard.empty() {
+				n.wildcard = nil
+			}
+		}
+		return
+	}
+	if next := n.children[token]; next != nil {
+		next.remove(tokens[1:], r)
+		if next.empty() {
+			delete(n.children, token)
+		}
+	}
+}
+
+func (n *ruleNode) empty() bool {
+	return len(n.rules) == 0 && len(n.tail) == 0 && len(n.children) == 0 && n.wildcard == nil
+}
+
+func (n *ruleNode) match(tokens []string, out []*Rule) []*Rule {
+	if len(tokens) == 0 {
+		return append(out, n.rules...)
+	}
+
+	out = append(out, n.tail...)
+	if next := n.children[tokens[0]]; next != nil {
+		out = next.match(tokens[1:], out)
+	}
+	if n.wildcard != nil {
+		out = n.wildcard.match(tokens[1:], out)
+	}
+	return out
+}
+
+// Check if name matches pattern.
+func matchName(pattern string, name string) bool {
+	if pattern == "" || pattern == name {
+		return true
+	}
+	if !strings.ContainsAny(pattern, "*>") {
+		return false
+	}
+
+	patternTokens := strings.Split(pattern, ".")
+	nameTokens := strings.Split(name, ".")
+	for i, token := range patternTokens {
+		if token == ">" && i == len(patternTokens)-1 {
+			return len(nameTokens) > i
+		}
+		if i >= len(nameTokens) || token != "*" && token != nameTokens[i] {
+			return false
+		}
+	}
+	return len(nameTokens) == len(patternTokens)
+}
@@ -0,0 +1,83 @@
+package con
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMatchName(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{"", "anything", true},
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.deleted", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.*.failed", "orders.42.failed", true},
+		{"orders.*.failed", "orders.42.done", false},
+		{"orders.>", "orders.eu.created", true},
+		{"orders.>", "orders", false},
+		{">", "orders", true},
+		{"*", "orders.created", false},
+	}
+
+	for _, c := range cases {
+		if matchName(c.pattern, c.name) != c.matched {
+			t.Errorf("Wrong result for pattern %q and name %q", c.pattern, c.name)
+		}
+	}
+}
+
+func TestRuleTable(t *testing.T) {
+	rules := []*Rule{
+		{msgName: ""},
+		{msgName: "orders.created"},
+		{msgName: "orders.*"},
+		{msgName: "orders.*.failed"},
+		{msgName: "orders.>"},
+		{msgName: "users.created"},
+		{msgRegexp: regexp.MustCompile("^orders\\.[0-9]+\\.")},
+	}
+	var table ruleTable
+	for i, r := range rules {
+		r.id = uint64(i + 1)
+		table.add(r)
+	}
+
+	lookup := func(name string) string {
+		var names []string
+		for _, r := range table.lookup(name) {
+			if r.msgRegexp != nil {
+				names = append(names, "regexp")
+			} else {
+				names = append(names, r.msgName)
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	if got := lookup("orders.created"); got != " orders.* orders.> orders.created" {
+		t.Errorf("Unexpected rules for orders.created: %q", got)
+	}
+	if got := lookup("orders.42.failed"); got != " orders.*.failed orders.> regexp" {
+		t.Errorf("Unexpected rules for orders.42.failed: %q", got)
+	}
+	if got := lookup("users.deleted"); got != "" {
+		t.Errorf("Unexpected rules for users.deleted: %q", got)
+	}
+
+	table.removeRule(rules[4])
+	table.remove(func(r *Rule) bool { return r.msgRegexp != nil })
+	if got := lookup("orders.42.failed"); got != " orders.*.failed" {
+		t.Errorf("Unexpected rules after removal: %q", got)
+	}
+	if got := lookup("orders.created"); got != " orders.* orders.created" {
+		t.Errorf("Unexpected rules after removal: %q", got)
+	}
+}
@@ -1,14 +1,125 @@
 package con
 
+import (
+	"regexp"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
 // Handler - incoming message handler function
 type Handler func(msg Msg) (ans []byte)
 
+// ErrHandler - incoming message handler function that can fail.
+// Error is sent back as error response if message is request.
+type ErrHandler func(msg Msg) (ans []byte, err error)
+
 // Rule provides matching pattern with handler function
 type Rule struct {
-	handler   Handler
+	id        uint64
+	internal  bool
+	handler   ErrHandler
 	once      bool
-	called    bool
+	called    int32
 	msgID     []byte
 	msgName   string
 	msgAuthor string
+
+	// Regexp and custom author matching
+	msgRegexp    *regexp.Regexp
+	authorRegexp *regexp.Regexp
+	authorMatch  func(c ConnectedClient) bool
+
+	// Headers of answer
+	answerHeaders Headers
+}
+
+// Check if rule matches message id. Message name is checked
+// by ruleIndex.
+func (r *Rule) matchID(msg Msg) bool {
+	return r.msgID == nil || BinEq(r.msgID, msg.ID)
+}
+
+// Check if rule matches author of message.
+func (r *Rule) matchAuthor(author *ConnectedClient) bool {
+	if r.msgAuthor != "" && !matchName(r.msgAuthor, author.Name) {
+		return false
+	}
+	if r.authorRegexp != nil && !r.authorRegexp.MatchString(author.Name) {
+		return false
+	}
+	if r.authorMatch != nil && !r.authorMatch(*author) {
+		return false
+	}
+	return true
+}
+
+// Check if rule can be called and mark once rule as called.
+func (r *Rule) take() bool {
+	if !r.once {
+		return true
+	}
+	return atomic.CompareAndSwapInt32(&r.called, 0, 1)
+}
+
+// Check if once rule was called.
+func (r *Rule) spent() bool {
+	return r.once && atomic.LoadInt32(&r.called) == 1
+}
+
+// Wrap Handler to ErrHandler.
+func (h Handler) withErr() ErrHandler {
+	return func(msg Msg) ([]byte, error) {
+		return h(msg), nil
+	}
+}
+
+// Call handler, panic is returned as *PanicError.
+func (h ErrHandler) safeCall(msg Msg) (ans []byte, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return h(msg)
+}
+
+// Call f, panic is returned as *PanicError.
+func safeRun(f func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return f()
+}
+
+// Subscription - handle of registered handler.
+type Subscription struct {
+	once        sync.Once
+	unsubscribe func()
+}
+
+// Unsubscribe removes handler.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(s.unsubscribe)
+}
+
+var lastRuleID uint64
+
+// Get id for new rule.
+func nextRuleID() uint64 {
+	return atomic.AddUint64(&lastRuleID, 1)
+}
+
+// Get rules without provided one.
+func withoutRule(rules []*Rule, rule *Rule) []*Rule {
+	for i := range rules {
+		if rules[i] == rule {
+			copy(rules[i:], rules[i+1:])
+			rules[len(rules)-1] = nil
+			return rules[:len(rules)-1]
+		}
+	}
+	return rules
 }
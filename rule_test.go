@@ -0,0 +1,119 @@
+package con
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestServerSubscriptions(t *testing.T) {
+	s := &Server{}
+	s.clients = map[string]*ConnectedClient{
+		"id": {ID: "id", Name: "worker", ready: true},
+	}
+	h := func(msg Msg) (ans []byte) { return }
+	plain := s.On("", "", h)
+	s.On("worker", "task", h)
+	s.OnAuthor(func(c ConnectedClient) bool { return true }, "", h)
+	s.OnUID(0, "", h)
+	s.OnRegexp(regexp.MustCompile("work"), nil, h)
+	s.OnRegexp(nil, regexp.MustCompile("task"), h)
+	once := s.Once("", "job", h)
+
+	// Off does not touch custom matched rules
+	s.Off("", "")
+	if n := len(s.rules.rules); n != 6 {
+		t.Errorf("Wrong number of rules after Off: %d", n)
+	}
+	plain.Unsubscribe()
+	if n := len(s.rules.rules); n != 6 {
+		t.Errorf("Unsubscribe after Off removed rule: %d", n)
+	}
+	s.Off("worker", "task")
+	if n := len(s.rules.rules); n != 5 {
+		t.Errorf("Wrong number of rules after Off: %d", n)
+	}
+
+	// Spent once rule is removed
+	s.dispatch("id", Msg{ID: []byte("0123456789ab"), Author: "id", Name: "job"}, nil)
+	s.handlers.Wait()
+	if n := len(s.rules.rules); n != 4 {
+		t.Errorf("Spent rule is not removed: %d", n)
+	}
+	once.Unsubscribe()
+	if n := len(s.rules.rules); n != 4 {
+		t.Errorf("Unsubscribe of spent rule removed other rule: %d", n)
+	}
+}
+
+func TestClientSubscriptions(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{}
+	server.On("", "echo", func(msg Msg) (ans []byte) {
+		return msg.Body
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{}
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	rules := func() int {
+		client.Lock()
+		defer client.Unlock()
+		return len(client.rules.rules)
+	}
+
+	calls := make(chan string, 10)
+	h := func(msg Msg) (ans []byte) {
+		calls <- msg.Name
+		return
+	}
+	news := client.On("news", h)
+	client.On("alert", h)
+	client.On("", h)
+	client.OnRegexp(regexp.MustCompile("^alert$"), h)
+
+	// Unsubscribe and Off
+	news.Unsubscribe()
+	client.Off("alert")
+	client.Off("")
+	if n := rules(); n != 1 {
+		t.Errorf("Wrong number of rules: %d", n)
+	}
+	server.Send("client", "news", nil)
+	server.Send("client", "alert", nil)
+	select {
+	case called := <-calls:
+		if called != "alert" {
+			t.Errorf("Unexpected call: %q", called)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Regexp rule is removed by Off")
+	}
+	select {
+	case called := <-calls:
+		t.Errorf("Unexpected call: %q", called)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Rule of answered request is removed
+	answers := make(chan Msg, 1)
+	if err := client.Req("echo", []byte("hi"), answers); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ans := <-answers:
+		if string(ans.Body) != "hi" {
+			t.Errorf("Unexpected answer: %q", ans.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No answer")
+	}
+	if n := rules(); n != 1 {
+		t.Errorf("Rule of answered request is not removed: %d", n)
+	}
+}
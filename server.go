@@ -1,13 +1,18 @@
 package con
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"os"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // ConnectedClient - id, name and stream of connected client
@@ -15,13 +20,171 @@ type ConnectedClient struct {
 	ID     string
 	Name   string
 	Stream net.Conn
+
+	// Negotiated protocol version and features.
+	Version  int
+	Features []string
+
+	// TLS connection state. Nil for plain connections.
+	TLS *tls.ConnectionState
+
+	// Credentials of peer process (linux unix sockets only).
+	Cred *PeerCred
+
+	// Identity of client: name from certificate (CN or the
+	// first SAN) or result of Server.Authenticate.
+	Identity Identity
+
+	// Handshake is completed
+	ready bool
+
+	// Slots of handlers in flight
+	inflight chan struct{}
+
+	// Outbound queue
+	out *writer
+
+	// Reader with idle and heartbeat timeouts
+	reader    *deadlineReader
+	heartbeat bool
+
+	// Why server closed connection
+	reason error
+
+	// Versions, features and credentials sent before handshake
+	hello []byte
+
+	// Joined groups
+	groups map[string]bool
 }
 
+// Request to client waiting for answer.
+type pendingReq struct {
+	clientID string
+	ch       chan Msg
+}
+
+// Lifecycle hooks of clients.
+type serverHooks struct {
+	connect    []func(c ConnectedClient)
+	handshake  []func(c ConnectedClient)
+	disconnect []func(c ConnectedClient, reason error)
+}
+
+// DefaultTLSHandshakeTimeout - max duration of TLS handshake
+// with client.
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
 // Server - server struct
 type Server struct {
-	sync.Mutex
-	Clients []ConnectedClient
-	rules   []Rule
+	sync.RWMutex
+	Clients []*ConnectedClient
+
+	// Codec for typed messages. Nil - DefaultCodec.
+	Codec Codec
+
+	// MinVersion - the lowest protocol version server accepts.
+	MinVersion int
+
+	// TLSConfig enables TLS for tcp addresses. Set ClientAuth
+	// and ClientCAs for mutual TLS.
+	TLSConfig *tls.Config
+
+	// NameFromCert - use identity of client certificate as
+	// client name instead of the one sent in handshake. Clients
+	// without certificate are rejected. Requires TLSConfig with
+	// ClientAuth VerifyClientCertIfGiven or stronger.
+	NameFromCert bool
+
+	// TLSHandshakeTimeout - max duration of TLS handshake with
+	// client, 0 - DefaultTLSHandshakeTimeout.
+	TLSHandshakeTimeout time.Duration
+
+	// Authenticate is called on handshake before client is
+	// marked as connected. Rejected clients get error and are
+	// disconnected.
+	Authenticate Authenticator
+
+	// Dispatch - how handlers are executed, concurrently (default)
+	// or in order of messages of each client.
+	Dispatch DispatchMode
+
+	// QueueSize - size of handlers queue of each client in ordered
+	// dispatch modes. Reading from client is paused while its queue
+	// is full. 0 - DefaultQueueSize.
+	QueueSize int
+
+	// Workers - max number of running handlers, 0 - unlimited.
+	// Reading from clients is paused while all workers are busy.
+	Workers int
+
+	// MaxInFlight - max number of queued and running handlers of
+	// each client, 0 - unlimited. Reading from client is paused
+	// when the limit is hit, so the client is slowed down by the
+	// connection flow control. Handlers which wait for answers of
+	// the same client should not rely on it.
+	MaxInFlight int
+
+	// WriteQueueSize - size of outbound queue of each client,
+	// 0 - DefaultWriteQueueSize.
+	WriteQueueSize int
+
+	// WritePolicy - what to do when outbound queue of client is
+	// full. Default - wait for free space.
+	WritePolicy WritePolicy
+
+	// WriteTimeout - max duration of writing to client, 0 - no
+	// limit. Client is disconnected when deadline is exceeded.
+	WriteTimeout time.Duration
+
+	// Batch - coalescing of outbound messages, nil - defaults.
+	Batch *BatchOptions
+
+	// MaxNameLen - max length of message name, 0 - 255.
+	MaxNameLen int
+
+	// MaxBodySize - max size of message body, 0 - DefaultMaxBodySize,
+	// negative - no limit. Clients which send larger frames get
+	// protocol error and are disconnected.
+	MaxBodySize int
+
+	// BorrowBodies - handlers get id and body of message without
+	// copying, they are valid only until handler returns. Reading
+	// from client waits for handlers of each message, so messages
+	// of one client are handled one by one and handlers should not
+	// wait for answers of the same client.
+	BorrowBodies bool
+
+	// ErrorHandler is called on errors which can not be returned
+	// to caller, e.g. protocol errors of clients and panics of
+	// handlers, interceptors, hooks and AuthorizeJoin (*PanicError).
+	ErrorHandler ErrorHandler
+
+	// Heartbeat enables pings of clients which support them.
+	// Clients which do not answer are disconnected. Nil - disabled.
+	Heartbeat *HeartbeatOptions
+
+	// IdleTimeout - clients which send nothing during it are
+	// disconnected, 0 - no limit.
+	IdleTimeout time.Duration
+
+	// AuthorizeJoin is called when client asks to join group,
+	// returned error is sent back to client. Nil - any group.
+	AuthorizeJoin func(c ConnectedClient, group string) error
+
+	rules        ruleTable
+	hooks        serverHooks
+	middleware   []Middleware
+	interceptors []Interceptor
+	clients      map[string]*ConnectedClient
+	pending      map[string]pendingReq
+	pendingLock  sync.Mutex
+	listeners    []net.Listener
+	sockets      []string
+	handlers     sync.WaitGroup
+	workers      dispatcher
+	ready        bool
+	closing      bool
 }
 
 // Listen start listening for incomming clients.
@@ -35,18 +198,40 @@ func (s *Server) Listen(address string) error {
 		connType = "tcp"
 	}
 
+	// Names can be taken only from verified certificates
+	if s.NameFromCert && (s.TLSConfig == nil || s.TLSConfig.ClientAuth < tls.VerifyClientCertIfGiven) {
+		return ErrCertNotVerified
+	}
+
 	// Setup listener
+	s.Lock()
+	if s.closing {
+		s.Unlock()
+		return ErrServerClosed
+	}
 	listener, err := setupListener(connType, address)
 	if err != nil {
+		s.Unlock()
 		return err
 	}
+	if connType == "unix" {
+		s.sockets = append(s.sockets, address)
+	} else if s.TLSConfig != nil {
+		listener = tls.NewListener(listener, s.TLSConfig)
+	}
+	s.listeners = append(s.listeners, listener)
 
 	// Add handler for handshake
-	s.Lock()
-	s.rules = append(s.rules, Rule{
-		handler: s.handshakeHandler,
-		msgName: "handshake",
-	})
+	if !s.ready {
+		s.rules.add(&Rule{
+			id:       nextRuleID(),
+			internal: true,
+			handler:  s.handshakeHandler,
+			msgName:  "handshake",
+		})
+		s.workers.limit(s.QueueSize, s.Workers)
+		s.ready = true
+	}
 	s.Unlock()
 
 	// Listen for -> clients -> messages
@@ -65,101 +250,607 @@ func (s *Server) ListenAll(addresses []string) {
 	}
 }
 
-// On subscribes for some messages.
-func (s *Server) On(clientName string, msgName string, handler Handler) {
-	s.Lock()
-	s.rules = append(s.rules, Rule{
-		handler:   handler,
+// On subscribes for some messages. Client and message names
+// can be patterns with "*" and ">" wildcards, empty - any.
+func (s *Server) On(clientName string, msgName string, handler Handler) *Subscription {
+	return s.addRule(Rule{
+		handler:   handler.withErr(),
 		msgAuthor: clientName,
 		msgName:   msgName,
 	})
-	s.Unlock()
 }
 
 // Once subscribes for the next message.
-func (s *Server) Once(clientName string, msgName string, handler Handler) {
-	s.Lock()
-	s.rules = append(s.rules, Rule{
+func (s *Server) Once(clientName string, msgName string, handler Handler) *Subscription {
+	return s.addRule(Rule{
+		handler:   handler.withErr(),
+		msgAuthor: clientName,
+		msgName:   msgName,
+		once:      true,
+	})
+}
+
+// OnErr subscribes for some messages with handler that can
+// fail. Returned error is sent back to requesting client.
+func (s *Server) OnErr(clientName string, msgName string, handler ErrHandler) *Subscription {
+	return s.addRule(Rule{
+		handler:   handler,
+		msgAuthor: clientName,
+		msgName:   msgName,
+	})
+}
+
+// OnceErr subscribes for the next message with handler that
+// can fail.
+func (s *Server) OnceErr(clientName string, msgName string, handler ErrHandler) *Subscription {
+	return s.addRule(Rule{
 		handler:   handler,
 		msgAuthor: clientName,
 		msgName:   msgName,
 		once:      true,
 	})
+}
+
+// OnAuthor subscribes for messages of clients matched by
+// provided function.
+func (s *Server) OnAuthor(match func(c ConnectedClient) bool, msgName string, handler Handler) *Subscription {
+	return s.addRule(Rule{
+		handler:     handler.withErr(),
+		msgName:     msgName,
+		authorMatch: match,
+	})
+}
+
+// OnUID subscribes for messages of clients connected via unix
+// socket by process of provided user.
+func (s *Server) OnUID(uid uint32, msgName string, handler Handler) *Subscription {
+	return s.OnAuthor(func(c ConnectedClient) bool {
+		return c.Cred != nil && c.Cred.UID == uid
+	}, msgName, handler)
+}
+
+// OnRegexp subscribes for messages which names match msgName
+// from clients which names match clientName. Nil - any.
+func (s *Server) OnRegexp(clientName *regexp.Regexp, msgName *regexp.Regexp, handler Handler) *Subscription {
+	return s.addRule(Rule{
+		handler:      handler.withErr(),
+		msgRegexp:    msgName,
+		authorRegexp: clientName,
+	})
+}
+
+// Off removes all handlers subscribed with provided client
+// and message names. Handlers of OnAuthor, OnUID and OnRegexp
+// are removed only by Unsubscribe.
+func (s *Server) Off(clientName string, msgName string) {
+	s.Lock()
+	s.rules.remove(func(r *Rule) bool {
+		return !r.internal && r.authorMatch == nil && r.authorRegexp == nil && r.msgRegexp == nil &&
+			r.msgAuthor == clientName && r.msgName == msgName
+	})
+	s.Unlock()
+}
+
+// OnConnect subscribes on accepted connections. Handshake is
+// not done yet, so client has no name.
+func (s *Server) OnConnect(h func(c ConnectedClient)) {
+	s.Lock()
+	s.hooks.connect = append(s.hooks.connect, h)
+	s.Unlock()
+}
+
+// OnHandshake subscribes on clients which completed handshake.
+func (s *Server) OnHandshake(h func(c ConnectedClient)) {
+	s.Lock()
+	s.hooks.handshake = append(s.hooks.handshake, h)
+	s.Unlock()
+}
+
+// OnDisconnect subscribes on lost connections. Reason is io.EOF
+// if client closed connection, *ProtocolError, ErrHeartbeatTimeout,
+// ErrIdleTimeout, ErrKicked, ErrServerClosed or error of reading.
+func (s *Server) OnDisconnect(h func(c ConnectedClient, reason error)) {
+	s.Lock()
+	s.hooks.disconnect = append(s.hooks.disconnect, h)
 	s.Unlock()
 }
 
+// Use adds middlewares of handlers. They are called in order
+// of adding, the first one is the outermost.
+func (s *Server) Use(mw ...Middleware) {
+	s.Lock()
+	s.middleware = append(s.middleware, mw...)
+	s.Unlock()
+}
+
+// Intercept adds interceptors of outbound messages: sends,
+// broadcasts, requests and answers of handlers.
+func (s *Server) Intercept(i ...Interceptor) {
+	s.Lock()
+	s.interceptors = append(s.interceptors, i...)
+	s.Unlock()
+}
+
+func (s *Server) addRule(rule Rule) *Subscription {
+	r := &rule
+	r.id = nextRuleID()
+	s.Lock()
+	s.rules.add(r)
+	s.Unlock()
+
+	return &Subscription{unsubscribe: func() {
+		s.Lock()
+		s.rules.removeRule(r)
+		s.Unlock()
+	}}
+}
+
 // Broadcast sends message to all connected clients.
 func (s *Server) Broadcast(msgName string, body []byte) error {
-	s.Lock()
-	for i := range s.Clients {
-		c := s.Clients[i]
-		var meta byte
-		if body != nil {
-			meta |= MsgWithBody
+	return s.BroadcastMsg(Msg{Name: msgName, Body: body})
+}
+
+// BroadcastMsg sends message with headers to all connected
+// clients. Messages are queued, slow clients do not block others.
+// Returns the first error of queueing.
+func (s *Server) BroadcastMsg(msg Msg) error {
+	return s.sendTo(func(c *ConnectedClient) bool {
+		return true
+	}, msg)
+}
+
+// Send sends message to client by its name.
+func (s *Server) Send(clientName string, msgName string, body []byte) error {
+	return s.SendMsg(clientName, Msg{Name: msgName, Body: body})
+}
+
+// SendMsg sends message with headers to client by its name.
+func (s *Server) SendMsg(clientName string, msg Msg) error {
+	return s.sendTo(func(c *ConnectedClient) bool {
+		return c.Name == clientName
+	}, msg)
+}
+
+// Queue message to matched clients which completed handshake.
+// Frames are encoded under lock and queued without it, so full
+// queues do not block dispatch.
+func (s *Server) sendTo(match func(c *ConnectedClient) bool, msg Msg) error {
+	err := s.intercept(&msg)
+	if err != nil {
+		return err
+	}
+
+	var meta byte
+	if msg.Body != nil {
+		meta |= MsgWithBody
+	}
+
+	var outs []*writer
+	var frames [][]byte
+	s.RLock()
+	for _, c := range s.Clients {
+		if !c.ready || !match(c) {
+			continue
 		}
-		err := writeMsg(c.Stream, BID12(), meta, msgName, body)
+		frame, err := encodeFrame(BID12(), meta, msg.Name, c.headers(msg.Headers), msg.Body)
 		if err != nil {
+			s.RUnlock()
 			return err
 		}
+		outs = append(outs, c.out)
+		frames = append(frames, frame)
 	}
-	s.Unlock()
-	return nil
+	s.RUnlock()
+
+	for i := range outs {
+		if e := outs[i].write(frames[i]); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
-// Send sends message to client by its name.
-func (s *Server) Send(clientName string, msgName string, body []byte) error {
-	s.Lock()
-	for i := range s.Clients {
-		c := s.Clients[i]
-		if c.Name == clientName {
-			var meta byte
-			if body != nil {
-				meta |= MsgWithBody
-			}
-			err := writeMsg(c.Stream, BID12(), meta, msgName, body)
-			if err != nil {
-				return err
+// Request sends request to client by its name and waits for
+// answer until it comes, ctx is done or client disconnects.
+// Error response of client handler is returned as *RemoteError.
+func (s *Server) Request(ctx context.Context, clientName string, msgName string, body []byte) (Msg, error) {
+	msg := Msg{Name: msgName, Body: body}
+	err := s.intercept(&msg)
+	if err != nil {
+		return Msg{}, err
+	}
+
+	id := BID12()
+	s.RLock()
+	var client *ConnectedClient
+	for _, c := range s.Clients {
+		if c.ready && c.Name == clientName {
+			client = c
+			break
+		}
+	}
+	s.RUnlock()
+	if client == nil {
+		return Msg{}, ErrNoClient
+	}
+
+	ch := s.addPending(id, client.ID)
+	err = client.out.writeFrame(id, requestMeta(msg.Body), msg.Name, client.headers(msg.Headers), msg.Body)
+	if err != nil {
+		s.removePending(id)
+		return Msg{}, err
+	}
+
+	ans, err := s.wait(ctx, id, ch)
+	if err != nil {
+		return ans, err
+	}
+	return ans, ans.Err()
+}
+
+// RequestAll sends request to all clients with provided name and
+// gathers answers until all of them answer or ctx is done.
+// Disconnected clients are skipped. Error responses are returned
+// as messages, see Msg.Err.
+func (s *Server) RequestAll(ctx context.Context, clientName string, msgName string, body []byte) ([]Msg, error) {
+	msg := Msg{Name: msgName, Body: body}
+	err := s.intercept(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids [][12]byte
+	var chans []chan Msg
+	var clients []*ConnectedClient
+	s.RLock()
+	for _, c := range s.Clients {
+		if c.ready && c.Name == clientName {
+			clients = append(clients, c)
+		}
+	}
+	s.RUnlock()
+	for _, c := range clients {
+		id := BID12()
+		ch := s.addPending(id, c.ID)
+		err := c.out.writeFrame(id, requestMeta(msg.Body), msg.Name, c.headers(msg.Headers), msg.Body)
+		if err != nil {
+			s.removePending(id)
+			continue
+		}
+		ids = append(ids, id)
+		chans = append(chans, ch)
+	}
+	if len(chans) == 0 {
+		return nil, ErrNoClient
+	}
+
+	answers := make([]Msg, 0, len(chans))
+	for i := range chans {
+		ans, err := s.wait(ctx, ids[i], chans[i])
+		if err == ErrDisconnected {
+			continue
+		}
+		if err != nil {
+			// Deadline, forget the rest but keep answers which
+			// already came
+			for j := i + 1; j < len(ids); j++ {
+				s.removePending(ids[j])
+				select {
+				case ans, ok := <-chans[j]:
+					if ok {
+						answers = append(answers, ans)
+					}
+				default:
+				}
 			}
+			break
+		}
+		answers = append(answers, ans)
+	}
+	return answers, nil
+}
+
+// Flush waits until queued messages are written to all clients.
+func (s *Server) Flush(ctx context.Context) error {
+	s.RLock()
+	clients := s.Clients
+	s.RUnlock()
+	for _, c := range clients {
+		err := c.out.flush(ctx)
+		if err != nil && err != ErrDisconnected {
+			return err
 		}
 	}
-	s.Unlock()
 	return nil
 }
 
 // Disconnect disconnects client by its id or name
 func (s *Server) Disconnect(client string) error {
 	s.Lock()
-	for i := range s.Clients {
-		if s.Clients[i].ID == client || s.Clients[i].Name == client {
-			err := s.Clients[i].Stream.Close()
-			if err != nil {
-				return err
+	defer s.Unlock()
+	for _, c := range s.Clients {
+		if c.ID == client || c.Name == client {
+			c.close(ErrKicked)
+			return c.Stream.Close()
+		}
+	}
+	return nil
+}
+
+// Shutdown gracefully stops the server: stops accepting new
+// clients, sends EventGoodbye message to connected ones and waits
+// for running handlers. When ctx is done - closes connections
+// without waiting.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Lock()
+	s.closing = true
+	s.closeListeners()
+	clients := s.Clients
+	s.Unlock()
+	// Goodbye is skipped for clients with full queue, so a stalled
+	// client does not block shutdown
+	for _, c := range clients {
+		frame, _ := encodeFrame(BID12(), 0, EventGoodbye, nil, nil)
+		c.out.offer(frame)
+	}
+
+	// Wait for running handlers
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Write the rest of queued messages
+	for _, c := range clients {
+		if err == nil {
+			err = c.out.flush(ctx)
+			if err == ErrDisconnected {
+				err = nil
 			}
-			break
 		}
 	}
+
+	s.Lock()
+	s.closeClients()
 	s.Unlock()
-	return nil
+	return err
 }
 
-// Handle handshake message.
-func (s *Server) handshakeHandler(msg Msg) []byte {
-	i := 0
+// Close immediately closes all listeners and connections.
+func (s *Server) Close() error {
 	s.Lock()
-	for i = range s.Clients {
-		c := &s.Clients[i]
-		if c.ID == msg.Author {
-			// Update client name
-			c.Name = string(msg.Body)
-
-			// Answer to client
-			var id [12]byte
-			copy(id[:], msg.ID)
-			break
+	s.closing = true
+	err := s.closeListeners()
+	s.closeClients()
+	s.Unlock()
+	return err
+}
+
+// Close listeners and remove unix sockets.
+// Should be called under lock.
+func (s *Server) closeListeners() error {
+	var err error
+	for i := range s.listeners {
+		if e := s.listeners[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for i := range s.sockets {
+		os.Remove(s.sockets[i])
+	}
+	s.listeners = nil
+	s.sockets = nil
+	return err
+}
+
+// Close connections of all clients.
+// Should be called under lock.
+func (s *Server) closeClients() {
+	for _, c := range s.Clients {
+		c.close(ErrServerClosed)
+		c.Stream.Close()
+	}
+}
+
+// Handle handshake message.
+func (s *Server) handshakeHandler(msg Msg) ([]byte, error) {
+	s.RLock()
+	c := s.client(msg.Author)
+	if c == nil {
+		s.RUnlock()
+		return nil, fatalError{ErrDisconnected}
+	}
+	hello := c.hello
+	identity := c.Identity
+	peer := PeerInfo{
+		Addr:     c.Stream.RemoteAddr(),
+		TLS:      c.TLS,
+		Cred:     c.Cred,
+		CertName: c.Identity.Name,
+	}
+	s.RUnlock()
+
+	// Legacy client sends name only, without hello
+	var info handshakeInfo
+	if hello != nil {
+		var err error
+		info, err = decodeHandshake(hello, true)
+		if err != nil {
+			return nil, fatalError{err}
+		}
+	}
+	info.value = string(msg.Body)
+	version, features, err := negotiate(info, s.MinVersion, Features)
+	if err != nil {
+		return nil, fatalError{&RemoteError{Code: CodeIncompatible, Message: err.Error()}}
+	}
+
+	if s.NameFromCert {
+		if peer.CertName == "" {
+			return nil, fatalError{&RemoteError{Code: CodeAuthFailed, Message: ErrNoCert.Error()}}
 		}
+		info.value = peer.CertName
 	}
+
+	// Check credentials
+	if s.Authenticate != nil {
+		identity, err = s.Authenticate(info.value, info.credentials, peer)
+		if err != nil {
+			return nil, fatalError{&RemoteError{Code: CodeAuthFailed, Message: err.Error()}}
+		}
+		if identity.Name != "" {
+			info.value = identity.Name
+		} else {
+			identity.Name = peer.CertName
+		}
+	}
+
+	s.Lock()
+	c = s.client(msg.Author)
+	if c == nil {
+		s.Unlock()
+		return nil, fatalError{ErrDisconnected}
+	}
+	c.Name = info.value
+	c.Identity = identity
+	c.Version = version
+	c.Features = features
+	c.ready = true
+	c.heartbeat = s.Heartbeat != nil && s.Heartbeat.Interval > 0 && hasFeature(features, FeatureHeartbeat)
+	id := c.ID
+	client := *c
+	hooks := s.hooks.handshake
 	s.Unlock()
-	return []byte(s.Clients[i].ID)
+
+	for _, h := range hooks {
+		s.runHook(id, func() { h(client) })
+	}
+
+	// Ping client
+	if client.heartbeat {
+		c.reader.setTimeout(s.IdleTimeout, s.Heartbeat)
+		out := c.out
+		go sendPings(s.Heartbeat.Interval, out.done, func() error {
+			return out.writeFrame(BID12(), 0, pingName, nil, nil)
+		})
+	}
+
+	// Legacy client expects only id
+	if version == 0 {
+		return []byte(id), nil
+	}
+	return encodeHandshake(handshakeInfo{
+		value:    id,
+		version:  version,
+		features: features,
+	}, false), nil
+}
+
+// Register pending request to client.
+func (s *Server) addPending(id [12]byte, clientID string) chan Msg {
+	ch := make(chan Msg, 1)
+	s.pendingLock.Lock()
+	if s.pending == nil {
+		s.pending = make(map[string]pendingReq)
+	}
+	s.pending[string(id[:])] = pendingReq{clientID, ch}
+	s.pendingLock.Unlock()
+	return ch
+}
+
+// Remove pending request.
+func (s *Server) removePending(id [12]byte) {
+	s.pendingLock.Lock()
+	delete(s.pending, string(id[:]))
+	s.pendingLock.Unlock()
+}
+
+// Pass answer to pending request, borrowed message is copied.
+// Returns false if message is not an answer.
+func (s *Server) answerPending(clientID string, msg Msg, borrowed bool) bool {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	p, ok := s.pending[string(msg.ID)]
+	if !ok || p.clientID != clientID {
+		return false
+	}
+	delete(s.pending, string(msg.ID))
+	if borrowed {
+		msg = msg.copy()
+	}
+	p.ch <- msg
+	return true
+}
+
+// Close pending requests of disconnected client.
+func (s *Server) failPending(clientID string) {
+	s.pendingLock.Lock()
+	for id, p := range s.pending {
+		if p.clientID == clientID {
+			close(p.ch)
+			delete(s.pending, id)
+		}
+	}
+	s.pendingLock.Unlock()
+}
+
+// Wait for answer of pending request.
+func (s *Server) wait(ctx context.Context, id [12]byte, ch chan Msg) (Msg, error) {
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return Msg{}, ErrDisconnected
+		}
+		return msg, nil
+	case <-ctx.Done():
+		s.removePending(id)
+		return Msg{}, ctx.Err()
+	}
+}
+
+// Stats returns snapshot of handlers execution.
+func (s *Server) Stats() DispatchStats {
+	return s.workers.stats()
+}
+
+// Pass outbound message through interceptors.
+func (s *Server) intercept(msg *Msg) error {
+	s.RLock()
+	interceptors := s.interceptors
+	s.RUnlock()
+	return intercept(msg, interceptors)
+}
+
+// Pass error to ErrorHandler.
+func (s *Server) reportErr(clientID string, err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(clientID, err)
+	}
+}
+
+// Call hook, panic is passed to ErrorHandler.
+func (s *Server) runHook(clientID string, hook func()) {
+	err := safeRun(func() error {
+		hook()
+		return nil
+	})
+	if err != nil {
+		s.reportErr(clientID, err)
+	}
+}
+
+// Find connected client by id.
+// Should be called under lock.
+func (s *Server) client(id string) *ConnectedClient {
+	return s.clients[id]
 }
 
 // Try to setup listener. For unix socket, if got error
@@ -188,90 +879,380 @@ func (s *Server) handleClients(listener net.Listener) error {
 	for {
 		stream, err := listener.Accept()
 		if err != nil {
+			s.RLock()
+			closing := s.closing
+			s.RUnlock()
+			if closing {
+				return ErrServerClosed
+			}
 			return err
 		}
 
 		// Create and store new client
 		clientID := UID()
+		client := &ConnectedClient{
+			ID:       clientID,
+			Name:     "",
+			Stream:   stream,
+			Cred:     peerCred(stream),
+			inflight: inFlight(s.MaxInFlight),
+			out:      newWriter(stream, s.WriteQueueSize, s.WritePolicy, s.WriteTimeout, s.Batch),
+			reader:   &deadlineReader{conn: stream},
+		}
+		client.reader.setTimeout(s.IdleTimeout, nil)
 		s.Lock()
-		client := ConnectedClient{
-			ID:     clientID,
-			Name:   "",
-			Stream: stream,
+		// Accepted after clients were closed
+		if s.closing {
+			s.Unlock()
+			client.out.stop()
+			stream.Close()
+			return ErrServerClosed
+		}
+		if s.clients == nil {
+			s.clients = make(map[string]*ConnectedClient)
 		}
+		s.clients[clientID] = client
 		s.Clients = append(s.Clients, client)
 		s.Unlock()
 
 		// -> handleMessages
-		go s.handleMessages(clientID, stream)
+		go s.handleMessages(client)
 	}
 }
 
 // Handle client messages in current goroutine.
-func (s *Server) handleMessages(clientID string, stream io.ReadWriter) {
-	readStream(clientID, stream, func(msg Msg) bool {
-		s.Lock()
-		// Find handler
-		for i := range s.rules {
-			r := &s.rules[i]
-			matched := true
-			if r.msgID != nil {
-				matched = matched && BinEq(r.msgID, msg.ID)
-			}
-			if r.msgName != "" {
-				matched = matched && r.msgName == msg.Name
-			}
-			if r.msgAuthor != "" {
-				for i := range s.Clients {
-					c := &s.Clients[i]
-					if c.ID == msg.Author {
-						matched = matched && r.msgAuthor == c.Name
-						break
-					}
-				}
-			}
-			if matched {
-				// Call it and remove if needed
-				if r.once {
-					if !r.called {
-						go s.handleMessage(msg, r, stream)
-						r.called = true
-					}
-				} else {
-					go s.handleMessage(msg, r, stream)
-				}
-			}
+func (s *Server) handleMessages(client *ConnectedClient) {
+	clientID := client.ID
+	stream := client.Stream
+
+	// Finish TLS handshake and get client identity
+	if tlsStream, ok := stream.(*tls.Conn); ok {
+		timeout := s.TLSHandshakeTimeout
+		if timeout == 0 {
+			timeout = DefaultTLSHandshakeTimeout
 		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := tlsStream.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			// Client was not connected, cleanup without hooks
+			stream.Close()
+			client.out.stop()
+			s.Lock()
+			client.close(err)
+			delete(s.clients, clientID)
+			s.Clients = removeClient(s.Clients, clientID)
+			s.Unlock()
+			s.reportErr(clientID, err)
+			return
+		}
+		state := tlsStream.ConnectionState()
+		s.Lock()
+		client.TLS = &state
+		client.Identity.Name = certIdentity(state)
 		s.Unlock()
+	}
+
+	s.RLock()
+	connected := *client
+	hooks := s.hooks.connect
+	s.RUnlock()
+	for _, h := range hooks {
+		s.runHook(clientID, func() { h(connected) })
+	}
 
+	d := NewDecoder(client.reader)
+	d.MaxNameLen = s.MaxNameLen
+	d.MaxBodySize = s.MaxBodySize
+	d.Borrow = s.BorrowBodies
+	var borrowed *sync.WaitGroup
+	if d.Borrow {
+		borrowed = &sync.WaitGroup{}
+	}
+	err := readStream(clientID, d, func(msg Msg) bool {
+		s.dispatch(clientID, msg, borrowed)
+		if borrowed != nil {
+			borrowed.Wait()
+		}
 		return true
 	})
+	d.Release()
+
+	// Report protocol error to client and close connection
+	var protoErr *ProtocolError
+	if errors.As(err, &protoErr) {
+		client.out.write(protocolErrFrame(err))
+		client.out.closeAfterWrite()
+		select {
+		case <-client.out.done:
+		case <-time.After(time.Second):
+		}
+		stream.Close()
+		s.reportErr(clientID, err)
+	}
+	s.dispatch(clientID, disconnectMsg(clientID), nil)
 
 	// Client was disconnected, cleanup
+	stream.Close()
+	client.out.stop()
 	s.Lock()
-	var i int
-	for i = range s.Clients {
-		if s.Clients[i].ID == clientID {
-			// Disconnected
-			break
+	client.close(disconnectReason(err, client.heartbeat))
+	delete(s.clients, clientID)
+	s.Clients = removeClient(s.Clients, clientID)
+	disconnected := *client
+	disconnectHooks := s.hooks.disconnect
+	s.Unlock()
+	s.failPending(clientID)
+
+	for _, h := range disconnectHooks {
+		s.runHook(clientID, func() { h(disconnected, disconnected.reason) })
+	}
+}
+
+// Find handlers for message and start them. Dispatch holds
+// only read lock, so connections are handled in parallel.
+// Borrowed message is valid until handlers added to borrowed
+// are done.
+func (s *Server) dispatch(clientID string, msg Msg, borrowed *sync.WaitGroup) {
+	// Answer for pending request
+	if s.answerPending(clientID, msg, borrowed != nil) {
+		return
+	}
+
+	s.RLock()
+	// Do not start new handlers while shutting down except of
+	// disconnect ones, they are not waited for
+	if s.closing && msg.Name != EventDisconnect {
+		s.RUnlock()
+		return
+	}
+
+	// Hello precedes handshake
+	if msg.Name == helloName {
+		s.RUnlock()
+		s.Lock()
+		if c := s.client(clientID); c != nil && !c.ready {
+			c.hello = append([]byte(nil), msg.Body...)
 		}
+		s.Unlock()
+		return
+	}
+
+	// Drop messages of clients without handshake and repeated
+	// handshakes
+	author := s.client(clientID)
+	if author == nil || !author.ready && msg.Name != "handshake" || author.ready && msg.Name == "handshake" {
+		s.RUnlock()
+		return
+	}
+
+	// Heartbeats
+	switch msg.Name {
+	case pingName:
+		out := author.out
+		s.RUnlock()
+		out.writeFrame(BID12(), 0, pongName, nil, nil)
+		return
+	case pongName, EventGoodbye:
+		s.RUnlock()
+		return
+	case protocolErrorName:
+		s.RUnlock()
+		s.reportErr(clientID, msg.Err())
+		return
+	case joinName, leaveName:
+		out := author.out
+		s.RUnlock()
+		s.groupRequest(clientID, msg, out)
+		return
+	}
+
+	// Find handlers
+	var matched []*Rule
+	spent := false
+	for _, r := range s.rules.lookup(msg.Name) {
+		if r.matchID(msg) && r.matchAuthor(author) && r.take() {
+			matched = append(matched, r)
+			spent = spent || r.once
+		}
+	}
+	waited := !s.closing
+	if waited {
+		s.handlers.Add(len(matched))
+	}
+	key := s.Dispatch.key(clientID, msg.Name)
+	inflight := author.inflight
+	out := author.out
+	middleware := s.middleware
+	s.RUnlock()
+
+	// Remove called once rules
+	if spent {
+		s.Lock()
+		for _, r := range matched {
+			if r.once {
+				s.rules.removeRule(r)
+			}
+		}
+		s.Unlock()
+	}
+
+	// Start handlers, queue is filled without lock as handlers
+	// may need it
+	for _, r := range matched {
+		r := r
+		if borrowed != nil {
+			borrowed.Add(1)
+		}
+		s.workers.acquire(inflight)
+		s.workers.run(key, func() {
+			defer s.workers.release(inflight)
+			if borrowed != nil {
+				defer borrowed.Done()
+			}
+			if waited {
+				defer s.handlers.Done()
+			}
+			s.handleMessage(msg, r, out, middleware)
+		})
+	}
+
+	// Nobody will answer the request
+	if len(matched) == 0 && msg.Meta&MsgReq == MsgReq {
+		out.write(errFrame(msg, &RemoteError{
+			Code:    CodeNoHandler,
+			Message: "no handler for " + msg.Name,
+		}))
 	}
-	s.Clients = append(s.Clients[:i], s.Clients[i+1:]...)
-	s.Unlock()
 }
 
-func (s *Server) handleMessage(msg Msg, rule *Rule, stream io.ReadWriter) {
+func (s *Server) handleMessage(msg Msg, rule *Rule, out *writer, middleware []Middleware) {
 	handler := rule.handler
-	ans := handler(msg)
+	if !rule.internal {
+		handler = chain(handler, middleware)
+	}
+	ans, err := handler.safeCall(msg)
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		s.reportErr(msg.Author, err)
+	}
 
 	// Write answer
 	if msg.Meta&MsgReq == MsgReq {
+		if err != nil {
+			out.write(errFrame(msg, err))
+			if errors.As(err, &fatalError{}) {
+				out.closeAfterWrite()
+			}
+			return
+		}
+
+		answer := Msg{ID: msg.ID, Name: msg.Name, Headers: rule.answerHeaders, Body: ans}
+		if !rule.internal {
+			err = safeRun(func() error { return s.intercept(&answer) })
+			if err != nil {
+				if errors.As(err, &panicErr) {
+					s.reportErr(msg.Author, err)
+				}
+				out.write(errFrame(msg, err))
+				return
+			}
+		}
+
 		var meta byte
-		if ans != nil {
+		if answer.Body != nil {
 			meta = MsgWithBody
 		}
+		if answer.Headers != nil {
+			s.RLock()
+			if c := s.client(msg.Author); c != nil {
+				answer.Headers = c.headers(answer.Headers)
+			}
+			s.RUnlock()
+		}
+
 		var id [12]byte
 		copy(id[:], msg.ID)
-		writeMsg(stream, id, meta, msg.Name, ans)
+		out.writeFrame(id, meta, answer.Name, answer.Headers, answer.Body)
+	}
+}
+
+// Encode error response for request.
+func errFrame(msg Msg, err error) []byte {
+	var id [12]byte
+	copy(id[:], msg.ID)
+	frame, _ := encodeFrame(id, MsgWithBody|MsgErr, msg.Name, nil, encodeRemoteError(err))
+	return frame
+}
+
+// Copy clients without removed one.
+func removeClient(clients []*ConnectedClient, id string) []*ConnectedClient {
+	out := make([]*ConnectedClient, 0, len(clients))
+	for _, c := range clients {
+		if c.ID != id {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Set reason of disconnection if it is not set yet.
+// Should be called under lock.
+func (c *ConnectedClient) close(reason error) {
+	if c.reason == nil {
+		c.reason = reason
+	}
+}
+
+// Get reason of lost connection by error of reading.
+func disconnectReason(err error, heartbeat bool) error {
+	var netErr net.Error
+	switch {
+	case err == nil || errors.Is(err, io.EOF):
+		return io.EOF
+	case errors.As(err, &netErr) && netErr.Timeout():
+		if heartbeat {
+			return ErrHeartbeatTimeout
+		}
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+// Drop headers if client does not support them.
+func (c *ConnectedClient) headers(h Headers) Headers {
+	if !hasFeature(c.Features, FeatureHeaders) {
+		return nil
+	}
+	return h
+}
+
+// Get identity from verified client certificate: common name
+// or the first SAN. Unverified certificates have no identity.
+func certIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.IPAddresses) > 0:
+		return cert.IPAddresses[0].String()
+	}
+	return ""
+}
+
+// Get meta of request with body.
+func requestMeta(body []byte) byte {
+	if body != nil {
+		return MsgReq | MsgWithBody
 	}
+	return MsgReq
 }
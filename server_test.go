@@ -0,0 +1,447 @@
+package con
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	benchClients = 500
+	benchRules   = 5000
+)
+
+// Server with many clients and rules, without connections.
+func benchServer() *Server {
+	s := &Server{}
+	s.clients = make(map[string]*ConnectedClient)
+	for i := 0; i < benchClients; i++ {
+		c := &ConnectedClient{
+			ID:    "client-" + strconv.Itoa(i),
+			Name:  "name-" + strconv.Itoa(i),
+			ready: true,
+		}
+		s.clients[c.ID] = c
+		s.Clients = append(s.Clients, c)
+	}
+	for i := 0; i < benchRules; i++ {
+		s.On("name-"+strconv.Itoa(i%benchClients), "msg."+strconv.Itoa(i), func(msg Msg) (ans []byte) {
+			return
+		})
+	}
+	return s
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	s := benchServer()
+	msg := Msg{Author: "client-1", Name: "msg.1"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.dispatch("client-1", msg, nil)
+		}
+	})
+	b.StopTimer()
+	s.handlers.Wait()
+}
+
+// Previous dispatch: linear scan of all rules with author lookup
+// by scan of all clients under exclusive lock.
+func BenchmarkDispatchLinear(b *testing.B) {
+	s := benchServer()
+	var rules []*Rule
+	for _, r := range s.rules.rules {
+		rules = append(rules, r)
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	msg := Msg{Author: "client-1", Name: "msg.1"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lock.Lock()
+			for _, r := range rules {
+				matched := true
+				if r.msgName != "" {
+					matched = matched && r.msgName == msg.Name
+				}
+				if r.msgAuthor != "" {
+					for _, c := range s.Clients {
+						if c.ID == msg.Author {
+							matched = matched && r.msgAuthor == c.Name
+							break
+						}
+					}
+				}
+				if matched {
+					wg.Add(1)
+					go func(h ErrHandler) {
+						h(msg)
+						wg.Done()
+					}(r.handler)
+				}
+			}
+			lock.Unlock()
+		}
+	})
+	b.StopTimer()
+	wg.Wait()
+}
+
+func TestShutdownStalledClient(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{WriteQueueSize: 1}
+	go server.Listen(addr)
+	time.Sleep(50 * time.Millisecond)
+
+	// Client which does not read
+	stream, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	writeMsg(stream, BID12(), MsgReq|MsgWithBody, "handshake", []byte("stalled"))
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		body := make([]byte, 1<<20)
+		for server.Send("stalled", "data", body) == nil {
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Shutdown(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Wrong error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown is blocked by stalled client")
+	}
+}
+
+func TestShutdownEvents(t *testing.T) {
+	for _, graceful := range []bool{true, false} {
+		addr := testTCPAddr(t)
+		server := Server{}
+		disconnected := make(chan string, 1)
+		server.On("", EventDisconnect, func(msg Msg) (ans []byte) {
+			disconnected <- msg.Author
+			return
+		})
+		go server.Listen(addr)
+		time.Sleep(50 * time.Millisecond)
+
+		client := Client{}
+		goodbye := make(chan struct{}, 1)
+		client.On(EventGoodbye, func(msg Msg) (ans []byte) {
+			goodbye <- struct{}{}
+			return
+		})
+		client.On("goodbye", func(msg Msg) (ans []byte) {
+			t.Error("Goodbye is passed to user-level rule")
+			return
+		})
+		if err := client.Connect(addr, "client"); err != nil {
+			t.Fatal(err)
+		}
+
+		if graceful {
+			server.Shutdown(context.Background())
+			select {
+			case <-goodbye:
+			case <-time.After(time.Second):
+				t.Error("No goodbye on Shutdown")
+			}
+		} else {
+			server.Close()
+		}
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second):
+			t.Errorf("No disconnect event, graceful: %v", graceful)
+		}
+		client.Disconnect()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	sock := t.TempDir() + "/server.sock"
+	addr := testTCPAddr(t)
+	server := Server{}
+	finished := make(chan struct{})
+	server.On("", "slow", func(msg Msg) (ans []byte) {
+		time.Sleep(100 * time.Millisecond)
+		close(finished)
+		return []byte("done")
+	})
+	server.ListenAll([]string{sock, addr})
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{}
+	goodbye := make(chan struct{}, 1)
+	client.On(EventGoodbye, func(msg Msg) (ans []byte) {
+		goodbye <- struct{}{}
+		return
+	})
+	if err := client.Connect(sock, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	answers := make(chan Msg, 1)
+	go func() {
+		ans, err := client.Request(context.Background(), "slow", nil)
+		if err != nil {
+			t.Errorf("Request failed: %v", err)
+		}
+		answers <- ans
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Running handler is waited for and its answer is written
+	select {
+	case <-finished:
+	default:
+		t.Error("Handler is not waited for")
+	}
+	if ans := <-answers; string(ans.Body) != "done" {
+		t.Errorf("Unexpected answer: %q", ans.Body)
+	}
+	select {
+	case <-goodbye:
+	case <-time.After(time.Second):
+		t.Error("No goodbye on Shutdown")
+	}
+
+	// Every listener is stopped
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("Socket file is not removed: %v", err)
+	}
+	for _, a := range []string{sock, addr} {
+		if stream, err := Dial(a); err == nil {
+			stream.Close()
+			t.Errorf("Listener of %s is not stopped", a)
+		}
+	}
+	if err := server.Listen(addr); err != ErrServerClosed {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{}
+	release := make(chan struct{})
+	defer close(release)
+	server.On("", "stuck", func(msg Msg) (ans []byte) {
+		<-release
+		return
+	})
+	go server.Listen(addr)
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{}
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Request(context.Background(), "stuck", nil)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Connections are closed without waiting when ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wrong error: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != ErrDisconnected {
+			t.Errorf("Wrong error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Connection is not closed")
+	}
+}
+
+func TestClose(t *testing.T) {
+	sock := t.TempDir() + "/server.sock"
+	addr := testTCPAddr(t)
+	server := Server{}
+	server.ListenAll([]string{sock, addr})
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{}
+	states := make(chan ClientState, 4)
+	client.OnState(func(state ClientState) {
+		states <- state
+	})
+	if err := client.Connect(addr, "client"); err != nil {
+		t.Fatal(err)
+	}
+	<-states // connecting
+	<-states // connected
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case state := <-states:
+		if state != StateClosed {
+			t.Errorf("Wrong state: %s", state)
+		}
+	case <-time.After(time.Second):
+		t.Error("Connection is not closed")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("Socket file is not removed: %v", err)
+	}
+	for _, a := range []string{sock, addr} {
+		if stream, err := Dial(a); err == nil {
+			stream.Close()
+			t.Errorf("Listener of %s is not stopped", a)
+		}
+	}
+}
+
+func TestServerRequest(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{}
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{}
+	client.On("echo", func(msg Msg) (ans []byte) {
+		return msg.Body
+	})
+	client.OnErr("fail", func(msg Msg) (ans []byte, err error) {
+		return nil, &RemoteError{Code: 42, Message: "bad"}
+	})
+	client.On("quit", func(msg Msg) (ans []byte) {
+		server.Disconnect("worker")
+		return
+	})
+	if err := client.Connect(addr, "worker"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ans, err := server.Request(ctx, "worker", "echo", []byte("hello"))
+	if err != nil || string(ans.Body) != "hello" {
+		t.Errorf("Unexpected answer: %q, %v", ans.Body, err)
+	}
+	_, err = server.Request(ctx, "worker", "fail", nil)
+	var re *RemoteError
+	if !errors.As(err, &re) || re.Code != 42 || re.Message != "bad" {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if _, err = server.Request(ctx, "nobody", "echo", nil); err != ErrNoClient {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if _, err = server.Request(ctx, "worker", "quit", nil); err != ErrDisconnected {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestServerRequestAll(t *testing.T) {
+	addr := testTCPAddr(t)
+	server := Server{}
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	release := make(chan struct{})
+	defer close(release)
+	for _, slow := range []bool{true, false} {
+		slow := slow
+		client := &Client{}
+		client.On("status", func(msg Msg) (ans []byte) {
+			if slow {
+				<-release
+			}
+			return []byte("ok")
+		})
+		if err := client.Connect(addr, "pool"); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+	}
+
+	// Answers which came before deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	answers, err := server.RequestAll(ctx, "pool", "status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answers) != 1 || string(answers[0].Body) != "ok" {
+		t.Errorf("Unexpected answers: %+v", answers)
+	}
+	server.pendingLock.Lock()
+	if len(server.pending) != 0 {
+		t.Errorf("Pending requests are left: %d", len(server.pending))
+	}
+	server.pendingLock.Unlock()
+}
+
+// Listener which returns provided connections.
+type testListener struct {
+	conns chan net.Conn
+}
+
+func (l testListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l testListener) Close() error   { return nil }
+func (l testListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestAcceptAfterClose(t *testing.T) {
+	server := Server{}
+	server.Close()
+
+	// Connection accepted right before Close returns after it
+	l := testListener{make(chan net.Conn, 1)}
+	local, remote := net.Pipe()
+	defer remote.Close()
+	l.conns <- local
+	close(l.conns)
+	if err := server.handleClients(l); err != ErrServerClosed {
+		t.Errorf("Wrong error: %v", err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection is not closed: %v", err)
+	}
+	if len(server.Clients) != 0 {
+		t.Errorf("Client is added to closed server: %d", len(server.Clients))
+	}
+}
@@ -0,0 +1,256 @@
+package con
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Generate certificate signed by parent (self-signed if parent is nil).
+func testCert(t testing.TB, cn string, parent *tls.Certificate, ca bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Get free tcp address.
+func testTCPAddr(t testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := testCert(t, "Test CA", nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := testCert(t, "server", &ca, false)
+	clientCert := testCert(t, "worker", &ca, false)
+
+	addr := testTCPAddr(t)
+	server := Server{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		},
+		NameFromCert: true,
+	}
+	server.On("worker", "ping", func(msg Msg) (ans []byte) {
+		return []byte("pong")
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Client name is taken from certificate
+	client := Client{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      pool,
+		},
+	}
+	err := client.Connect(addr, "somebody-else")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	ans, err := client.Request(context.Background(), "ping", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ans.Body) != "pong" {
+		t.Errorf("Unexpected answer: %q", ans.Body)
+	}
+
+	server.Lock()
+	if len(server.Clients) != 1 || server.Clients[0].Identity.Name != "worker" || server.Clients[0].Name != "worker" {
+		t.Errorf("Unexpected client: %+v", server.Clients)
+	}
+	server.Unlock()
+
+	// Without client certificate
+	anon := Client{TLSConfig: &tls.Config{RootCAs: pool}}
+	if anon.Connect(addr, "anon") == nil {
+		t.Error("Client without certificate should be rejected")
+	}
+}
+
+func TestUnverifiedCert(t *testing.T) {
+	ca := testCert(t, "Test CA", nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := testCert(t, "server", &ca, false)
+
+	// Names are not taken from unverified certificates
+	insecure := Server{
+		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAnyClientCert},
+		NameFromCert: true,
+	}
+	if err := insecure.Listen(testTCPAddr(t)); err != ErrCertNotVerified {
+		t.Errorf("Wrong error: %v", err)
+	}
+
+	addr := testTCPAddr(t)
+	certNames := make(chan string, 1)
+	server := Server{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequestClientCert,
+		},
+		Authenticate: func(name string, credentials []byte, peer PeerInfo) (Identity, error) {
+			certNames <- peer.CertName
+			return Identity{}, nil
+		},
+	}
+	server.On("admin", "ping", func(msg Msg) (ans []byte) {
+		return []byte("pong")
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Self-signed certificate gives no identity
+	client := Client{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{testCert(t, "admin", nil, false)},
+			RootCAs:      pool,
+		},
+	}
+	err := client.Connect(addr, "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if name := <-certNames; name != "" {
+		t.Errorf("Identity from unverified certificate: %q", name)
+	}
+	_, err = client.Request(context.Background(), "ping", nil)
+	var re *RemoteError
+	if !errors.As(err, &re) || re.Code != CodeNoHandler {
+		t.Errorf("Handler of admin is called: %v", err)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	addr := testTCPAddr(t)
+	errs := make(chan error, 1)
+	server := Server{
+		TLSConfig:           &tls.Config{Certificates: []tls.Certificate{testCert(t, "server", nil, false)}},
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+		ErrorHandler: func(client string, err error) {
+			errs <- err
+		},
+	}
+	server.OnConnect(func(c ConnectedClient) {
+		t.Error("OnConnect is called without TLS handshake")
+	})
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Client which does not start handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Connection is not closed: %v", err)
+	}
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Error("Handshake error is not reported")
+	}
+
+	server.Lock()
+	if len(server.Clients) != 0 {
+		t.Errorf("Client is not removed: %+v", server.Clients)
+	}
+	server.Unlock()
+}
+
+func TestCertIdentityKept(t *testing.T) {
+	ca := testCert(t, "Test CA", nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	addr := testTCPAddr(t)
+	server := Server{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{testCert(t, "server", &ca, false)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		},
+		// Authenticator which only validates
+		Authenticate: func(name string, credentials []byte, peer PeerInfo) (Identity, error) {
+			return Identity{Attrs: map[string]string{"role": "worker"}}, nil
+		},
+	}
+	go server.Listen(addr)
+	defer server.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	client := Client{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{testCert(t, "worker", &ca, false)},
+			RootCAs:      pool,
+		},
+	}
+	if err := client.Connect(addr, "guest"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	server.Lock()
+	defer server.Unlock()
+	if len(server.Clients) != 1 {
+		t.Fatalf("Unexpected clients: %+v", server.Clients)
+	}
+	c := server.Clients[0]
+	if c.Name != "guest" || c.Identity.Name != "worker" || c.Identity.Attrs["role"] != "worker" {
+		t.Errorf("Unexpected client: %q, %+v", c.Name, c.Identity)
+	}
+}
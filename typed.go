@@ -0,0 +1,74 @@
+package con
+
+import "context"
+
+// SendTyped encodes v with client codec and sends it. Codec is
+// announced in content-type header.
+func SendTyped[T any](c *Client, name string, v T) error {
+	codec := codecOr(c.Codec)
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.SendMsg(Msg{
+		Name:    name,
+		Headers: Headers{HeaderContentType: codec.ContentType()},
+		Body:    body,
+	})
+}
+
+// RequestTyped encodes v with client codec, sends request
+// and decodes answer.
+func RequestTyped[Req, Resp any](ctx context.Context, c *Client, name string, v Req) (Resp, error) {
+	var resp Resp
+	codec := codecOr(c.Codec)
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return resp, err
+	}
+
+	msg, err := c.RequestMsg(ctx, Msg{
+		Name:    name,
+		Headers: Headers{HeaderContentType: codec.ContentType()},
+		Body:    body,
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	err = decodeBody(msg.Codec(codec), msg.Body, &resp)
+	return resp, err
+}
+
+// OnTyped subscribes for messages with handler of decoded body.
+// Result of handler is encoded with server codec and sent
+// back if message is request.
+func OnTyped[T, R any](s *Server, clientName string, msgName string, handler func(v T) (R, error)) *Subscription {
+	codec := codecOr(s.Codec)
+	return s.addRule(Rule{
+		handler: func(msg Msg) ([]byte, error) {
+			var v T
+			err := decodeBody(msg.Codec(codec), msg.Body, &v)
+			if err != nil {
+				return nil, err
+			}
+
+			r, err := handler(v)
+			if err != nil {
+				return nil, err
+			}
+			return codec.Marshal(r)
+		},
+		msgAuthor:     clientName,
+		msgName:       msgName,
+		answerHeaders: Headers{HeaderContentType: codec.ContentType()},
+	})
+}
+
+// Decode body, empty body leaves v untouched.
+func decodeBody(codec Codec, body []byte, v interface{}) error {
+	if len(body) == 0 {
+		return nil
+	}
+	return codec.Unmarshal(body, v)
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
-	"log"
 	"math/rand"
 	"time"
 )
@@ -91,155 +90,118 @@ func BinEq(a, b []byte) bool {
 
 // Write message to stream
 func writeMsg(stream io.Writer, id [12]byte, meta byte, name string, body []byte) error {
+	return writeFrame(stream, id, meta, name, nil, body)
+}
+
+// Write message with headers to stream
+func writeFrame(stream io.Writer, id [12]byte, meta byte, name string, headers Headers, body []byte) error {
+	frame, err := encodeFrame(id, meta, name, headers, body)
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(frame)
+	return err
+}
+
+// Encode message with headers
+func encodeFrame(id [12]byte, meta byte, name string, headers Headers, body []byte) ([]byte, error) {
 	metaArr := [1]byte{meta}
 	nameBytes := []byte(name)
 	nameLen := len(nameBytes)
 	bodyLen := uint64(len(body))
-	buf := make([]byte, 0, 22+nameLen+len(body))
+	if nameLen > 255 {
+		return nil, ErrNameTooLong
+	}
+	headersBytes, err := encodeHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, 26+nameLen+len(headersBytes)+len(body))
 	msgBuff := bytes.NewBuffer(buf)
 
-	if nameLen > 255 {
-		log.Fatal("Cannot use message name longer then 255 bytes")
+	if bodyLen == 0 {
+		metaArr[0] &^= MsgWithBody
+	}
+	if headersBytes != nil {
+		metaArr[0] |= MsgWithHeaders
+	} else {
+		metaArr[0] &^= MsgWithHeaders
 	}
 
-	_, err := msgBuff.Write(id[0:12])
+	_, err = msgBuff.Write(id[0:12])
 	if err != nil {
-		return err
+		return nil, err
 	}
 	_, err = msgBuff.Write(metaArr[0:1])
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = binary.Write(msgBuff, binary.BigEndian, uint8(nameLen))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	_, err = msgBuff.Write(nameBytes[:])
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if headersBytes != nil {
+		err = binary.Write(msgBuff, binary.BigEndian, uint32(len(headersBytes)))
+		if err != nil {
+			return nil, err
+		}
+		_, err = msgBuff.Write(headersBytes)
+		if err != nil {
+			return nil, err
+		}
 	}
 	if bodyLen > 0 {
 		err = binary.Write(msgBuff, binary.BigEndian, bodyLen)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		_, err = msgBuff.Write(body[:bodyLen])
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	_, err = stream.Write(msgBuff.Bytes())
-	return err
+	return msgBuff.Bytes(), nil
 }
 
 // Continuously read stream and parse
 // incomming data to messages. Will Stop if
-// msgHandler return false.
-func readStream(clientID string, stream io.Reader, msgHandler func(msg Msg) bool) {
-	msgBuff := make([]byte, 0, 1024)
-	chunkBuff := make([]byte, 256)
-	var readLen uint64
-	var id []byte
-	var meta byte
-	var withBody bool
-	var nameLen uint64
-	var name string
-	var nameEnd uint64
-	var bodyStart uint64
-	var bodyEnd uint64
-	var bodyLen uint64
-	var body []byte
-	var msgEnd uint64
-
+// msgHandler return false. Returns error
+// which stopped reading. Messages with
+// reserved names are dropped.
+func readStream(clientID string, d *Decoder, msgHandler func(msg Msg) bool) error {
 	for {
-		n, err := stream.Read(chunkBuff[:])
+		msg, err := d.Decode()
 		if err != nil {
-			break
+			return err
 		}
-
-		msgBuff = append(msgBuff, chunkBuff[0:n]...)
-		readLen += uint64(n)
-
-		for len(msgBuff) > 0 {
-			// Id
-			if id == nil && readLen >= 12 {
-				id = make([]byte, 12)
-				copy(id, msgBuff[0:12])
-			}
-
-			// Meta
-			if meta == 0 && readLen >= 13 {
-				meta = msgBuff[12]
-				withBody = (meta & MsgWithBody) == MsgWithBody
-			}
-
-			// Name len
-			if nameLen == 0 && readLen >= 14 {
-				nameLen = uint64(msgBuff[13])
-				nameEnd = 14 + nameLen
-				if !withBody {
-					msgEnd = nameEnd
-				}
-			}
-
-			// Name
-			if nameLen > 0 && readLen >= nameEnd {
-				name = string(msgBuff[14:nameEnd])
-			}
-
-			// Body len
-			if withBody && nameLen > 0 && bodyLen == 0 && readLen >= nameEnd+8 {
-				bodyLen = binary.BigEndian.Uint64(msgBuff[nameEnd : nameEnd+8])
-				bodyStart = nameEnd + 8
-				bodyEnd = bodyStart + bodyLen
-				msgEnd = bodyEnd
-			}
-
-			// Body
-			if withBody && bodyLen > 0 && readLen >= bodyEnd {
-				body = make([]byte, bodyLen)
-				copy(body, msgBuff[bodyStart:bodyEnd])
-			}
-
-			// Full message
-			if msgEnd > 0 && readLen >= msgEnd {
-				if !msgHandler(Msg{
-					ID:     id,
-					Author: clientID,
-					Meta:   meta,
-					Name:   name,
-					Body:   body,
-				}) {
-					return
-				}
-
-				// Cleanup
-				id = nil
-				meta = 0
-				nameLen = 0
-				bodyLen = 0
-				name = ""
-				body = nil
-				if readLen == msgEnd {
-					msgBuff = msgBuff[:0]
-					readLen = 0
-					msgEnd = 0
-					break
-				} else {
-					msgBuff = msgBuff[msgEnd:]
-					readLen -= msgEnd
-					msgEnd = 0
-					continue
-				}
-			} else {
-				break
-			}
+		if spoofed(msg.Name) {
+			continue
+		}
+		msg.Author = clientID
+		if !msgHandler(msg) {
+			return nil
 		}
 	}
+}
 
-	msgHandler(Msg{
+// Message about lost connection.
+func disconnectMsg(clientID string) Msg {
+	return Msg{
 		Author: clientID,
-		Name:   "disconnect",
-	})
+		Name:   EventDisconnect,
+	}
+}
+
+// Encode frame about protocol error sent before closing connection.
+func protocolErrFrame(err error) []byte {
+	frame, _ := encodeFrame(BID12(), MsgWithBody|MsgErr, protocolErrorName, nil, encodeRemoteError(&RemoteError{
+		Code:    CodeProtocol,
+		Message: err.Error(),
+	}))
+	return frame
 }
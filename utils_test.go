@@ -3,6 +3,7 @@ package con
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -91,3 +92,14 @@ func TestWriteMsg(t *testing.T) {
 		t.Error("Unexpected output")
 	}
 }
+
+func TestWriteMsgLongName(t *testing.T) {
+	var consumer bytes.Buffer
+	err := writeMsg(&consumer, BID12(), 0, strings.Repeat("a", 256), nil)
+	if err != ErrNameTooLong {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if consumer.Len() != 0 {
+		t.Error("Message is written")
+	}
+}
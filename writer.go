@@ -0,0 +1,328 @@
+package con
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WritePolicy - what to do when outbound queue of client is full.
+type WritePolicy int
+
+const (
+	// WriteBlock - wait for free space in the queue.
+	WriteBlock WritePolicy = iota
+
+	// WriteDropOldest - drop the oldest queued message.
+	WriteDropOldest
+
+	// WriteDropNewest - drop the message being sent.
+	WriteDropNewest
+
+	// WriteDisconnect - disconnect the client.
+	WriteDisconnect
+)
+
+// DefaultWriteQueueSize - size of outbound queue of client.
+const DefaultWriteQueueSize = 256
+
+// DefaultBatchBytes - max size of coalesced write.
+const DefaultBatchBytes = 64 * 1024
+
+// BatchOptions - coalescing of outbound messages. Queued messages
+// are written with one vectored write (net.Buffers). Messages are
+// coalesced anyway while the connection is busy, options allow
+// to wait for more messages trading latency for throughput.
+type BatchOptions struct {
+	// Delay - max time message waits for the others before write.
+	// 0 - only already queued messages are coalesced.
+	Delay time.Duration
+
+	// MaxBytes - batch is written when it reaches this size.
+	// 0 - DefaultBatchBytes.
+	MaxBytes int
+}
+
+// Connection to write to.
+type writeConn interface {
+	io.WriteCloser
+	SetWriteDeadline(t time.Time) error
+}
+
+// Max number of queued flush and close requests.
+const maxMarks = 16
+
+// Outbound queue of connection with its own writing goroutine.
+// Flush and close requests are queued separately, so they are
+// never dropped with frames.
+type writer struct {
+	stream   writeConn
+	frames   chan []byte
+	marks    chan mark
+	policy   WritePolicy
+	timeout  time.Duration
+	delay    time.Duration
+	maxBytes int
+	buf      []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Request to flush or close. Frames queued before it are written
+// first.
+type mark struct {
+	flushed chan struct{} // closed when previous frames are written
+	close   bool          // close connection after previous frames
+}
+
+func newWriter(stream writeConn, size int, policy WritePolicy, timeout time.Duration, batch *BatchOptions) *writer {
+	if size <= 0 {
+		size = DefaultWriteQueueSize
+	}
+	w := &writer{
+		stream:   stream,
+		frames:   make(chan []byte, size),
+		marks:    make(chan mark, maxMarks),
+		policy:   policy,
+		timeout:  timeout,
+		maxBytes: DefaultBatchBytes,
+		done:     make(chan struct{}),
+	}
+	if batch != nil {
+		w.delay = batch.Delay
+		if batch.MaxBytes > 0 {
+			w.maxBytes = batch.MaxBytes
+		}
+	}
+	go w.run()
+	return w
+}
+
+// Queue encoded frame according to policy.
+func (w *writer) write(frame []byte) error {
+	select {
+	case <-w.done:
+		return ErrDisconnected
+	default:
+	}
+	select {
+	case w.frames <- frame:
+		return nil
+	default:
+	}
+
+	switch w.policy {
+	case WriteDropNewest:
+		return ErrQueueFull
+	case WriteDisconnect:
+		w.stream.Close()
+		w.stop()
+		return ErrQueueFull
+	case WriteDropOldest:
+		for {
+			select {
+			case <-w.done:
+				return ErrDisconnected
+			case w.frames <- frame:
+				return nil
+			default:
+			}
+			select {
+			case <-w.frames:
+			default:
+			}
+		}
+	}
+	return w.put(context.Background(), frame)
+}
+
+// Queue frame only if there is free space in the queue.
+func (w *writer) offer(frame []byte) error {
+	select {
+	case <-w.done:
+		return ErrDisconnected
+	case w.frames <- frame:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Encode and queue frame.
+func (w *writer) writeFrame(id [12]byte, meta byte, name string, headers Headers, body []byte) error {
+	frame, err := encodeFrame(id, meta, name, headers, body)
+	if err != nil {
+		return err
+	}
+	return w.write(frame)
+}
+
+// Wait until queued frames are written.
+func (w *writer) flush(ctx context.Context) error {
+	m := mark{flushed: make(chan struct{})}
+	select {
+	case w.marks <- m:
+	case <-w.done:
+		return ErrDisconnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-m.flushed:
+		return nil
+	case <-w.done:
+		return ErrDisconnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close connection after queued frames are written. Closes it
+// immediately if there are too many requests.
+func (w *writer) closeAfterWrite() {
+	select {
+	case w.marks <- mark{close: true}:
+	default:
+		w.stream.Close()
+		w.stop()
+	}
+}
+
+// Queue frame waiting for free space.
+func (w *writer) put(ctx context.Context, frame []byte) error {
+	select {
+	case w.frames <- frame:
+		return nil
+	case <-w.done:
+		return ErrDisconnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop writing goroutine, queued frames are dropped.
+func (w *writer) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+// Write queued frames until stop. Frames are written in
+// batches, connection is closed on write error.
+func (w *writer) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case frame := <-w.frames:
+			batch, m, ok := w.collect(frame, w.delay, -1)
+			if !ok || !w.writeBatch(batch) {
+				return
+			}
+			if m != nil && !w.mark(*m) {
+				return
+			}
+		case m := <-w.marks:
+			if !w.mark(m) {
+				return
+			}
+		}
+	}
+}
+
+// Collect batch starting with frame: queued frames up to max
+// count (negative - any) and maxBytes. With delay waits for more
+// frames, flush or close request ends waiting. Returns false
+// when writer is stopped.
+func (w *writer) collect(frame []byte, delay time.Duration, max int) (net.Buffers, *mark, bool) {
+	batch := net.Buffers{frame}
+	size := len(frame)
+	var timeout <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for size < w.maxBytes && (max < 0 || len(batch) < max) {
+		select {
+		case frame = <-w.frames:
+		default:
+			if timeout == nil {
+				return batch, nil, true
+			}
+			select {
+			case <-w.done:
+				return nil, nil, false
+			case frame = <-w.frames:
+			case m := <-w.marks:
+				return batch, &m, true
+			case <-timeout:
+				return batch, nil, true
+			}
+		}
+		batch = append(batch, frame)
+		size += len(frame)
+	}
+	return batch, nil, true
+}
+
+// Write frames queued before flush or close request and complete
+// it. Returns false when writer is stopped.
+func (w *writer) mark(m mark) bool {
+	// Some of them could be dropped meanwhile
+	for n := len(w.frames); n > 0; {
+		select {
+		case frame := <-w.frames:
+			batch, _, ok := w.collect(frame, 0, n)
+			if !ok || !w.writeBatch(batch) {
+				return false
+			}
+			n -= len(batch)
+		default:
+			n = 0
+		}
+	}
+
+	if m.close {
+		w.stream.Close()
+		w.stop()
+		return false
+	}
+	close(m.flushed)
+	return true
+}
+
+// Write batch of frames with one vectored write. Connections
+// without vectored writes, e.g. TLS, get batch joined into one
+// buffer, so it is one TLS record and one syscall too.
+func (w *writer) writeBatch(batch net.Buffers) bool {
+	if w.timeout > 0 {
+		w.stream.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	var err error
+	switch w.stream.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		_, err = batch.WriteTo(w.stream)
+	default:
+		if len(batch) == 1 {
+			_, err = w.stream.Write(batch[0])
+			break
+		}
+		w.buf = w.buf[:0]
+		for _, frame := range batch {
+			w.buf = append(w.buf, frame...)
+		}
+		_, err = w.stream.Write(w.buf)
+		if cap(w.buf) > 2*w.maxBytes {
+			w.buf = nil
+		}
+	}
+	if err != nil {
+		w.stream.Close()
+		w.stop()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,298 @@
+package con
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Writer to connection which peer does not read. The first
+// frame is taken by writing goroutine and stalls it.
+func stalledWriter(t *testing.T, policy WritePolicy, size int) (*writer, net.Conn) {
+	local, remote := net.Pipe()
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	w := newWriter(local, size, policy, 0, nil)
+	w.write([]byte{0})
+	for i := 0; len(w.frames) > 0; i++ {
+		if i == 100 {
+			t.Fatal("Frame is not taken by writer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return w, remote
+}
+
+func TestWriterPolicies(t *testing.T) {
+	got := make([]byte, 3)
+
+	w, remote := stalledWriter(t, WriteDropNewest, 2)
+	w.write([]byte{1})
+	w.write([]byte{2})
+	if err := w.write([]byte{3}); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	io.ReadFull(remote, got)
+	if string(got) != "\x00\x01\x02" {
+		t.Errorf("Unexpected frames with drop newest policy: %v", got)
+	}
+	remote.Close()
+
+	w, remote = stalledWriter(t, WriteDropOldest, 2)
+	for i := 1; i < 5; i++ {
+		if err := w.write([]byte{byte(i)}); err != nil {
+			t.Errorf("Unexpected error with drop oldest policy: %v", err)
+		}
+	}
+	io.ReadFull(remote, got)
+	if string(got) != "\x00\x03\x04" {
+		t.Errorf("Unexpected frames with drop oldest policy: %v", got)
+	}
+	remote.Close()
+
+	w, remote = stalledWriter(t, WriteDisconnect, 1)
+	w.write([]byte{1})
+	if err := w.write([]byte{2}); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if _, err := remote.Read(got); err != io.EOF {
+		t.Errorf("Expected closed connection, got %v", err)
+	}
+}
+
+func TestWriterTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	w := newWriter(local, 1, WriteBlock, 10*time.Millisecond, nil)
+	w.write([]byte{0})
+	select {
+	case <-w.done:
+	case <-time.After(time.Second):
+		t.Fatal("Writer is not stopped after deadline")
+	}
+	if err := w.write([]byte{1}); err != ErrDisconnected {
+		t.Errorf("Expected ErrDisconnected, got %v", err)
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	local, remote := net.Pipe()
+	w := newWriter(local, 4, WriteBlock, 0, nil)
+	for i := 0; i < 4; i++ {
+		w.write([]byte{byte(i)})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := w.flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline of flush, got %v", err)
+	}
+
+	go io.Copy(io.Discard, remote)
+	if err := w.flush(context.Background()); err != nil {
+		t.Errorf("Unexpected error of flush: %v", err)
+	}
+	w.closeAfterWrite()
+	<-w.done
+}
+
+func TestWriterDropOldestMarks(t *testing.T) {
+	w, remote := stalledWriter(t, WriteDropOldest, 2)
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- w.flush(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	w.closeAfterWrite()
+
+	// Dropped frames do not drop flush and close requests
+	for i := 1; i < 5; i++ {
+		w.write([]byte{byte(i)})
+	}
+	io.Copy(io.Discard, remote)
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Errorf("Unexpected error of flush: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Flush request is dropped")
+	}
+	select {
+	case <-w.done:
+	case <-time.After(time.Second):
+		t.Error("Close request is dropped")
+	}
+}
+
+// Unix socket connection with discarding peer.
+func benchConn(b *testing.B) net.Conn {
+	addr := b.TempDir() + "/bench.sock"
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		peer, err := l.Accept()
+		if err == nil {
+			io.Copy(io.Discard, peer)
+		}
+	}()
+	c, err := net.Dial("unix", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		c.Close()
+		l.Close()
+	})
+	return c
+}
+
+// Write of every message by its own call.
+func BenchmarkWriteDirect(b *testing.B) {
+	c := benchConn(b)
+	id := BID12()
+	body := []byte("small message body")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writeFrame(c, id, MsgWithBody, "repeat", nil, body)
+	}
+}
+
+func BenchmarkWriteBatched(b *testing.B) {
+	c := benchConn(b)
+	w := newWriter(c, 0, WriteBlock, 0, nil)
+	id := BID12()
+	body := []byte("small message body")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.writeFrame(id, MsgWithBody, "repeat", nil, body)
+	}
+	w.flush(context.Background())
+}
+
+func BenchmarkWriteBatchedDelay(b *testing.B) {
+	c := benchConn(b)
+	w := newWriter(c, 0, WriteBlock, 0, &BatchOptions{Delay: time.Millisecond})
+	id := BID12()
+	body := []byte("small message body")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.writeFrame(id, MsgWithBody, "repeat", nil, body)
+	}
+	w.flush(context.Background())
+}
+
+func TestClientBatchOrder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	names := make(chan string, 10)
+	streams := make(chan net.Conn, 1)
+	go func() {
+		stream, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		d := NewDecoder(stream)
+		defer d.Release()
+		for {
+			msg, err := d.Decode()
+			if err != nil {
+				return
+			}
+			switch msg.Name {
+			case "handshake":
+				var id [12]byte
+				copy(id[:], msg.ID)
+				writeMsg(stream, id, MsgWithBody, msg.Name, []byte("id"))
+				streams <- stream
+			case "progress", "work":
+				names <- msg.Name
+			}
+		}
+	}()
+
+	client := Client{Batch: &BatchOptions{Delay: 10 * time.Millisecond}}
+	client.On("work", func(msg Msg) []byte {
+		client.Send("progress", nil)
+		return []byte("done")
+	})
+	if err := client.Connect(l.Addr().String(), "worker"); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	writeMsg(<-streams, BID12(), MsgReq, "work", nil)
+
+	// Answer is written after messages sent by handler
+	for _, expected := range []string{"progress", "work"} {
+		select {
+		case name := <-names:
+			if name != expected {
+				t.Errorf("Expected %q, got %q", expected, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message %q is not received", expected)
+		}
+	}
+}
+
+// TLS connection over tcp with discarding peer.
+func benchTLSConn(b *testing.B) *tls.Conn {
+	cert := testCert(b, "127.0.0.1", nil, true)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		peer, err := l.Accept()
+		if err == nil {
+			io.Copy(io.Discard, peer)
+		}
+	}()
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		c.Close()
+		l.Close()
+	})
+	return c
+}
+
+func BenchmarkWriteDirectTLS(b *testing.B) {
+	c := benchTLSConn(b)
+	id := BID12()
+	body := []byte("small message body")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writeFrame(c, id, MsgWithBody, "repeat", nil, body)
+	}
+}
+
+func BenchmarkWriteBatchedTLS(b *testing.B) {
+	c := benchTLSConn(b)
+	w := newWriter(c, 0, WriteBlock, 0, nil)
+	id := BID12()
+	body := []byte("small message body")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.writeFrame(id, MsgWithBody, "repeat", nil, body)
+	}
+	w.flush(context.Background())
+}